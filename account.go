@@ -0,0 +1,342 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Local users and groups. Pets files can ask for a user or a group to exist,
+// optionally with specific properties. Missing accounts are created with
+// useradd(8) and groupadd(8), existing ones are fixed with usermod(8) and
+// groupmod(8). The accounts are read from /etc/passwd and /etc/group, under
+// RootDir if an alternate root is used.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// PetsUser is a local user that has to exist.
+type PetsUser struct {
+	Name string
+	// The following are only enforced if not empty
+	Uid   string
+	Home  string
+	Shell string
+	// Supplementary groups the user must be a member of. Other memberships
+	// are left alone.
+	Groups []string
+	// Create a system account. Only used when creating the user.
+	System bool
+}
+
+// PetsGroup is a local group that has to exist.
+type PetsGroup struct {
+	Name string
+	// Only enforced if not empty
+	Gid string
+	// Create a system group. Only used when creating the group.
+	System bool
+}
+
+// AddAccount sets the user this file has to ensure the existence of.
+func (pf *PetsFile) AddAccount(name string) {
+	pf.Account = &PetsUser{Name: name}
+}
+
+// AddAccountGroup sets the group this file has to ensure the existence of.
+// If the file has a user too, the group is its primary group.
+func (pf *PetsFile) AddAccountGroup(name string) {
+	pf.AccountGroup = &PetsGroup{Name: name}
+}
+
+// validId returns an error if the given uid or gid is not a number.
+func validId(id string) error {
+	if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+		return fmt.Errorf("invalid id '%s'", id)
+	}
+	return nil
+}
+
+// AddUid sets the uid of the user given before.
+func (pf *PetsFile) AddUid(uid string) error {
+	if pf.Account == nil {
+		return fmt.Errorf("uid %s given before any user", uid)
+	}
+
+	if err := validId(uid); err != nil {
+		return err
+	}
+
+	pf.Account.Uid = uid
+	return nil
+}
+
+// AddGid sets the gid of the group given before.
+func (pf *PetsFile) AddGid(gid string) error {
+	if pf.AccountGroup == nil {
+		return fmt.Errorf("gid %s given before any usergroup", gid)
+	}
+
+	if err := validId(gid); err != nil {
+		return err
+	}
+
+	pf.AccountGroup.Gid = gid
+	return nil
+}
+
+// AddHome sets the home directory of the user given before.
+func (pf *PetsFile) AddHome(home string) error {
+	if pf.Account == nil {
+		return fmt.Errorf("home %s given before any user", home)
+	}
+
+	pf.Account.Home = home
+	return nil
+}
+
+// AddShell sets the login shell of the user given before.
+func (pf *PetsFile) AddShell(shell string) error {
+	if pf.Account == nil {
+		return fmt.Errorf("shell %s given before any user", shell)
+	}
+
+	pf.Account.Shell = shell
+	return nil
+}
+
+// AddGroups sets the space separated supplementary groups of the user given
+// before.
+func (pf *PetsFile) AddGroups(groups string) error {
+	if pf.Account == nil {
+		return fmt.Errorf("groups %s given before any user", groups)
+	}
+
+	pf.Account.Groups = strings.Fields(groups)
+	return nil
+}
+
+// AddSystem marks the user and the group given before as system accounts.
+func (pf *PetsFile) AddSystem(value string) error {
+	system, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+
+	if pf.Account == nil && pf.AccountGroup == nil {
+		return fmt.Errorf("system given before any user or usergroup")
+	}
+
+	if pf.Account != nil {
+		pf.Account.System = system
+	}
+
+	if pf.AccountGroup != nil {
+		pf.AccountGroup.System = system
+	}
+
+	return nil
+}
+
+// GroupAction returns a GROUP_CREATE or GROUP_UPDATE PetsAction if the group
+// of the given trigger is missing or has the wrong gid, nil otherwise.
+func GroupAction(trigger *PetsFile) *PetsAction {
+	group := trigger.AccountGroup
+	if group == nil {
+		return nil
+	}
+
+	groups, err := readDb("/etc/group")
+	if err != nil {
+		log.Printf("[ERROR] cannot read groups: %v\n", err)
+		return nil
+	}
+
+	current := findEntry(groups, 0, group.Name)
+
+	if current == nil {
+		log.Printf("[INFO] group %s does not exist\n", group.Name)
+
+		args := []string{"groupadd"}
+		if group.Gid != "" {
+			args = append(args, "-g", group.Gid)
+		}
+		if group.System {
+			args = append(args, "-r")
+		}
+
+		return &PetsAction{
+			Cause:   GROUP_CREATE,
+			Command: NewCmd(withRoot(append(args, group.Name), "--prefix", RootDir)),
+			Trigger: trigger,
+		}
+	}
+
+	if group.Gid != "" && current[2] != group.Gid {
+		log.Printf("[INFO] group %s has gid %s instead of %s\n", group.Name, current[2], group.Gid)
+
+		return &PetsAction{
+			Cause:   GROUP_UPDATE,
+			Command: NewCmd(withRoot([]string{"groupmod", "-g", group.Gid, group.Name}, "--prefix", RootDir)),
+			Trigger: trigger,
+		}
+	}
+
+	log.Printf("[DEBUG] group %s is fine already\n", group.Name)
+	return nil
+}
+
+// missingGroups returns the groups among the given ones which user is not a
+// member of.
+func missingGroups(groups [][]string, user string, wanted []string) []string {
+	missing := []string{}
+
+	for _, name := range wanted {
+		group := findEntry(groups, 0, name)
+		if group == nil || !SliceContains(strings.Split(group[3], ","), user) {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// UserAction returns a USER_CREATE or USER_UPDATE PetsAction if the user of
+// the given trigger is missing or differs from what was asked, nil otherwise.
+func UserAction(trigger *PetsFile) *PetsAction {
+	user := trigger.Account
+	if user == nil {
+		return nil
+	}
+
+	users, err := readDb("/etc/passwd")
+	if err != nil {
+		log.Printf("[ERROR] cannot read users: %v\n", err)
+		return nil
+	}
+
+	groups, err := readDb("/etc/group")
+	if err != nil {
+		log.Printf("[ERROR] cannot read groups: %v\n", err)
+		return nil
+	}
+
+	current := findEntry(users, 0, user.Name)
+
+	if current == nil {
+		log.Printf("[INFO] user %s does not exist\n", user.Name)
+
+		args := []string{"useradd"}
+		if user.Uid != "" {
+			args = append(args, "-u", user.Uid)
+		}
+		if trigger.AccountGroup != nil {
+			args = append(args, "-g", trigger.AccountGroup.Name)
+		}
+		if len(user.Groups) > 0 {
+			args = append(args, "-G", strings.Join(user.Groups, ","))
+		}
+		if user.Home != "" {
+			args = append(args, "-d", user.Home)
+		}
+		if user.Shell != "" {
+			args = append(args, "-s", user.Shell)
+		}
+		if user.System {
+			args = append(args, "-r")
+		} else {
+			args = append(args, "-m")
+		}
+
+		return &PetsAction{
+			Cause:   USER_CREATE,
+			Command: NewCmd(withRoot(append(args, user.Name), "--prefix", RootDir)),
+			Trigger: trigger,
+		}
+	}
+
+	// passwd(5): name:password:UID:GID:GECOS:directory:shell
+	if len(current) < 7 {
+		log.Printf("[ERROR] invalid passwd entry for %s\n", user.Name)
+		return nil
+	}
+
+	args := []string{"usermod"}
+
+	if user.Uid != "" && current[2] != user.Uid {
+		log.Printf("[INFO] user %s has uid %s instead of %s\n", user.Name, current[2], user.Uid)
+		args = append(args, "-u", user.Uid)
+	}
+
+	if trigger.AccountGroup != nil {
+		// The group may be about to be created, or its gid changed
+		group := findEntry(groups, 0, trigger.AccountGroup.Name)
+		if group == nil || group[2] != current[3] || (trigger.AccountGroup.Gid != "" && trigger.AccountGroup.Gid != current[3]) {
+			log.Printf("[INFO] user %s has primary gid %s instead of group %s\n", user.Name, current[3], trigger.AccountGroup.Name)
+			args = append(args, "-g", trigger.AccountGroup.Name)
+		}
+	}
+
+	if missing := missingGroups(groups, user.Name, user.Groups); len(missing) > 0 {
+		log.Printf("[INFO] user %s is not a member of %v\n", user.Name, missing)
+		args = append(args, "-a", "-G", strings.Join(missing, ","))
+	}
+
+	if user.Home != "" && current[5] != user.Home {
+		log.Printf("[INFO] user %s has home %s instead of %s\n", user.Name, current[5], user.Home)
+		args = append(args, "-d", user.Home)
+	}
+
+	if user.Shell != "" && current[6] != user.Shell {
+		log.Printf("[INFO] user %s has shell %s instead of %s\n", user.Name, current[6], user.Shell)
+		args = append(args, "-s", user.Shell)
+	}
+
+	if len(args) == 1 {
+		log.Printf("[DEBUG] user %s is fine already\n", user.Name)
+		return nil
+	}
+
+	return &PetsAction{
+		Cause:   USER_UPDATE,
+		Command: NewCmd(withRoot(append(args, user.Name), "--prefix", RootDir)),
+		Trigger: trigger,
+	}
+}
+
+// CheckAccounts returns an error if different files declare the same user or
+// group, or the same uid or gid.
+func CheckAccounts(files []*PetsFile) error {
+	users := make(map[string]*PetsFile)
+	uids := make(map[string]*PetsFile)
+	groups := make(map[string]*PetsFile)
+	gids := make(map[string]*PetsFile)
+
+	for _, pf := range files {
+		if user := pf.Account; user != nil {
+			if other, exist := users[user.Name]; exist {
+				return fmt.Errorf("[ERROR] duplicate definition for user '%s': '%s' and '%s'\n", user.Name, pf.Source, other.Source)
+			}
+			users[user.Name] = pf
+
+			if other, exist := uids[user.Uid]; exist && user.Uid != "" {
+				return fmt.Errorf("[ERROR] uid %s used by both '%s' and '%s'\n", user.Uid, pf.Source, other.Source)
+			}
+			uids[user.Uid] = pf
+		}
+
+		if group := pf.AccountGroup; group != nil {
+			if other, exist := groups[group.Name]; exist {
+				return fmt.Errorf("[ERROR] duplicate definition for group '%s': '%s' and '%s'\n", group.Name, pf.Source, other.Source)
+			}
+			groups[group.Name] = pf
+
+			if other, exist := gids[group.Gid]; exist && group.Gid != "" {
+				return fmt.Errorf("[ERROR] gid %s used by both '%s' and '%s'\n", group.Gid, pf.Source, other.Source)
+			}
+			gids[group.Gid] = pf
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUserAction(t *testing.T) {
+	withRootDir(t, newTestRoot(t))
+
+	pf := NewPetsFile()
+	pf.Source = "/etc/pets/sparrow"
+	pf.AddAccount("sparrow")
+	assertNoError(t, pf.AddUid("4242"))
+	assertNoError(t, pf.AddShell("/bin/sh"))
+	assertNoError(t, pf.AddGroups("pirates"))
+
+	// Already fine
+	assertEquals(t, UserAction(pf) == nil, true)
+
+	assertNoError(t, pf.AddShell("/bin/bash"))
+	assertNoError(t, pf.AddGroups("pirates adm"))
+
+	action := UserAction(pf)
+	assertEquals(t, action.Cause.String(), "USER_UPDATE")
+	assertEquals(t, strings.Join(action.Command.Args[3:], " "), "-a -G adm -s /bin/bash sparrow")
+	assertEquals(t, action.Command.Args[1], "--prefix")
+
+	pf.AddAccount("turner")
+	assertNoError(t, pf.AddUid("4244"))
+	assertNoError(t, pf.AddSystem("true"))
+	pf.AddAccountGroup("pirates")
+
+	action = UserAction(pf)
+	assertEquals(t, action.Cause.String(), "USER_CREATE")
+	assertEquals(t, strings.Join(action.Command.Args[3:], " "), "-u 4244 -g pirates -r turner")
+}
+
+func TestGroupAction(t *testing.T) {
+	withRootDir(t, newTestRoot(t))
+
+	pf := NewPetsFile()
+	pf.Source = "/etc/pets/pirates"
+	pf.AddAccountGroup("pirates")
+
+	// No gid given, any will do
+	assertEquals(t, GroupAction(pf) == nil, true)
+
+	assertNoError(t, pf.AddGid("4250"))
+	action := GroupAction(pf)
+	assertEquals(t, action.Cause.String(), "GROUP_UPDATE")
+	assertEquals(t, strings.Join(action.Command.Args[3:], " "), "-g 4250 pirates")
+
+	pf.AddAccountGroup("navy")
+	assertNoError(t, pf.AddSystem("true"))
+	action = GroupAction(pf)
+	assertEquals(t, action.Cause.String(), "GROUP_CREATE")
+	assertEquals(t, strings.Join(action.Command.Args[3:], " "), "-r navy")
+
+	// Groups come before users, and before any file action
+	pf.AddAccount("norrington")
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, actions[0].Cause.String(), "GROUP_CREATE")
+	assertEquals(t, actions[1].Cause.String(), "USER_CREATE")
+}
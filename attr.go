@@ -0,0 +1,615 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// POSIX ACLs and extended attributes. Both are read with lgetxattr(2) at
+// planning time, ACLs being stored in the system.posix_acl_access attribute.
+// Symbolic links are never followed.
+// Changes are applied by running pets itself with the hidden "set-attr"
+// command, so that they are regular commands like all others and no external
+// tools such as setfacl(1) or setfattr(1) are needed.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// AttrCommand is the hidden pets command used to set ACLs and xattrs.
+const AttrCommand = "set-attr"
+
+// aclXattr is the extended attribute holding the access ACL of a file.
+const aclXattr = "system.posix_acl_access"
+
+// ACL entry tags and header version, see linux/posix_acl_xattr.h
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+	aclVersion  = 0x0002
+)
+
+// PetsACLEntry is a named user or group entry of a POSIX ACL, eg:
+// group:monitoring:r--
+type PetsACLEntry struct {
+	// Either "user" or "group"
+	Tag  string
+	Name string
+	// Permission bits: 4 read, 2 write, 1 execute
+	Perm uint16
+}
+
+// PetsXattr is an extended attribute.
+type PetsXattr struct {
+	Name  string
+	Value []byte
+}
+
+// String returns the entry in the format understood by ParseACLEntry.
+func (entry PetsACLEntry) String() string {
+	perm := []byte("---")
+	for i, c := range "rwx" {
+		if entry.Perm&(4>>i) != 0 {
+			perm[i] = byte(c)
+		}
+	}
+	return fmt.Sprintf("%s:%s:%s", entry.Tag, entry.Name, perm)
+}
+
+// ParseACLEntry parses a named entry in setfacl(1) syntax. The tag can be
+// abbreviated, and missing permissions omitted: g:monitoring:r is the same as
+// group:monitoring:r--
+func ParseACLEntry(text string) (PetsACLEntry, error) {
+	entry := PetsACLEntry{}
+
+	fields := strings.Split(text, ":")
+	if len(fields) != 3 || fields[1] == "" {
+		return entry, fmt.Errorf("invalid ACL entry '%s', expecting user:NAME:PERMS or group:NAME:PERMS", text)
+	}
+
+	switch fields[0] {
+	case "u", "user":
+		entry.Tag = "user"
+	case "g", "group":
+		entry.Tag = "group"
+	default:
+		return entry, fmt.Errorf("invalid ACL entry type '%s'", fields[0])
+	}
+
+	entry.Name = fields[1]
+
+	for _, c := range fields[2] {
+		switch c {
+		case 'r':
+			entry.Perm |= 4
+		case 'w':
+			entry.Perm |= 2
+		case 'x':
+			entry.Perm |= 1
+		case '-':
+		default:
+			return entry, fmt.Errorf("invalid ACL permissions '%s'", fields[2])
+		}
+	}
+
+	return entry, nil
+}
+
+// AddACL adds an entry to the ACL of the file.
+func (pf *PetsFile) AddACL(text string) error {
+	entry, err := ParseACLEntry(text)
+	if err == nil {
+		pf.ACL = append(pf.ACL, entry)
+	}
+	return err
+}
+
+// AddXattr parses an xattr directive: NAME=VALUE, where values starting with
+// 0x are hex-encoded like in the output of getfattr -e hex.
+func (pf *PetsFile) AddXattr(argument string) error {
+	name, value, found := strings.Cut(argument, "=")
+	if !found || !strings.Contains(name, ".") {
+		return fmt.Errorf("invalid xattr '%s', expecting NAMESPACE.NAME=VALUE", argument)
+	}
+
+	if strings.HasPrefix(name, "system.") {
+		return fmt.Errorf("invalid xattr '%s', use the acl directive for ACLs", name)
+	}
+
+	xattr := PetsXattr{Name: name, Value: []byte(value)}
+
+	if strings.HasPrefix(value, "0x") {
+		decoded, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+		if err != nil {
+			return fmt.Errorf("invalid hex value for xattr %s: %v", name, err)
+		}
+		xattr.Value = decoded
+	}
+
+	pf.Xattrs = append(pf.Xattrs, xattr)
+	return nil
+}
+
+// getXattr returns the value of the given extended attribute of path, and
+// false if it is not set.
+func getXattr(path, name string) ([]byte, bool, error) {
+	size, err := lgetxattr(path, name, nil)
+	if err == syscall.ENODATA {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	value := make([]byte, size)
+	size, err = lgetxattr(path, name, value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value[:size], true, nil
+}
+
+// lgetxattr is getxattr(2) without following symbolic links, which the
+// syscall package lacks.
+func lgetxattr(path, name string, value []byte) (int, error) {
+	pathPtr, namePtr, err := xattrPtrs(path, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	}
+
+	size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)), uintptr(valuePtr), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(size), nil
+}
+
+// lsetxattr is the lgetxattr counterpart for setxattr(2).
+func lsetxattr(path, name string, value []byte) error {
+	pathPtr, namePtr, err := xattrPtrs(path, name)
+	if err != nil {
+		return err
+	}
+
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)), uintptr(valuePtr), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// xattrPtrs returns path and name as C strings.
+func xattrPtrs(path, name string) (*byte, *byte, error) {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	namePtr, err := syscall.BytePtrFromString(name)
+	return pathPtr, namePtr, err
+}
+
+// aclEntry is an entry of a POSIX ACL as stored on disk.
+type aclEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+// readACL returns the access ACL of path. Files without one get the minimal
+// ACL equivalent to their mode.
+func readACL(path string) ([]aclEntry, error) {
+	value, found, err := getXattr(path, aclXattr)
+	if err != nil && err != syscall.EOPNOTSUPP {
+		return nil, err
+	}
+
+	if !found {
+		fileInfo, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		mode := uint16(fileInfo.Mode().Perm())
+		return []aclEntry{
+			{Tag: aclUserObj, Perm: mode >> 6 & 7},
+			{Tag: aclGroupObj, Perm: mode >> 3 & 7},
+			{Tag: aclOther, Perm: mode & 7},
+		}, nil
+	}
+
+	if len(value) < 4 || binary.LittleEndian.Uint32(value) != aclVersion {
+		return nil, fmt.Errorf("unsupported ACL of %s", path)
+	}
+
+	entries := make([]aclEntry, (len(value)-4)/8)
+	err = binary.Read(bytes.NewReader(value[4:]), binary.LittleEndian, entries)
+	return entries, err
+}
+
+// writeACL sets the given access ACL on path.
+func writeACL(path string, entries []aclEntry) error {
+	var buf bytes.Buffer
+
+	binary.Write(&buf, binary.LittleEndian, uint32(aclVersion))
+	binary.Write(&buf, binary.LittleEndian, entries)
+
+	return lsetxattr(path, aclXattr, buf.Bytes())
+}
+
+// aclId returns the uid or gid of the given entry.
+func aclId(entry PetsACLEntry) (uint32, error) {
+	var id string
+
+	if entry.Tag == "user" {
+		user, err := LookupUser(entry.Name)
+		if err != nil {
+			return 0, fmt.Errorf("unknown user %s", entry.Name)
+		}
+		id = user.Uid
+	} else {
+		group, err := LookupGroup(entry.Name)
+		if err != nil {
+			return 0, fmt.Errorf("unknown group %s", entry.Name)
+		}
+		id = group.Gid
+	}
+
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	return uint32(parsed), err
+}
+
+// aclTag returns the on-disk tag of the given entry.
+func aclTag(entry PetsACLEntry) uint16 {
+	if entry.Tag == "user" {
+		return aclUser
+	}
+	return aclGroup
+}
+
+// aclHas returns true if the given ACL grants the permissions of entry.
+// Permissions of named entries are limited by the mask.
+func aclHas(entries []aclEntry, entry PetsACLEntry) (bool, error) {
+	id, err := aclId(entry)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+
+	for _, current := range entries {
+		if current.Tag == aclTag(entry) && current.Id == id && current.Perm == entry.Perm {
+			found = true
+		}
+
+		if current.Tag == aclMask && current.Perm&entry.Perm != entry.Perm {
+			return false, nil
+		}
+	}
+
+	return found, nil
+}
+
+// mergeACL adds the wanted entries to the given ACL, replacing existing
+// entries for the same users and groups. Like setfacl(1) does, the mask is
+// recomputed to grant all permissions of the group class.
+func mergeACL(entries []aclEntry, wanted []PetsACLEntry) ([]aclEntry, error) {
+	for _, entry := range wanted {
+		id, err := aclId(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		merged := aclEntry{Tag: aclTag(entry), Perm: entry.Perm, Id: id}
+
+		replaced := false
+		for i, current := range entries {
+			if current.Tag == merged.Tag && current.Id == merged.Id {
+				entries[i] = merged
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			entries = append(entries, merged)
+		}
+	}
+
+	mask := uint16(0)
+	withMask := []aclEntry{}
+	for _, current := range entries {
+		switch current.Tag {
+		case aclUser, aclGroup, aclGroupObj:
+			mask |= current.Perm
+		}
+
+		if current.Tag != aclMask {
+			withMask = append(withMask, current)
+		}
+	}
+	withMask = append(withMask, aclEntry{Tag: aclMask, Perm: mask})
+
+	// The kernel wants entries sorted by tag, and named ones by id
+	sort.Slice(withMask, func(i, j int) bool {
+		if withMask[i].Tag != withMask[j].Tag {
+			return withMask[i].Tag < withMask[j].Tag
+		}
+		return withMask[i].Id < withMask[j].Id
+	})
+
+	return withMask, nil
+}
+
+// setACLMode sets the owner, owning group and other entries of the given ACL
+// to the permissions in mode.
+func setACLMode(entries []aclEntry, mode os.FileMode) {
+	for i, current := range entries {
+		switch current.Tag {
+		case aclUserObj:
+			entries[i].Perm = uint16(mode>>6) & 7
+		case aclGroupObj:
+			entries[i].Perm = uint16(mode>>3) & 7
+		case aclOther:
+			entries[i].Perm = uint16(mode) & 7
+		}
+	}
+}
+
+// aclHasMode returns true if the owner, owning group and other entries of the
+// given ACL have the permissions in mode.
+func aclHasMode(entries []aclEntry, mode os.FileMode) bool {
+	wanted := make([]aclEntry, len(entries))
+	copy(wanted, entries)
+	setACLMode(wanted, mode)
+
+	for i := range entries {
+		if entries[i] != wanted[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ACLMode returns the given mode of path as it shows once the given entries
+// are added to its ACL: the group permissions are those of the mask, which
+// grants all permissions of the group class. That includes named entries of
+// the ACL other than the given ones, as set-attr does.
+func ACLMode(path string, mode os.FileMode, wanted []PetsACLEntry) os.FileMode {
+	mask := mode >> 3 & 7
+	for _, entry := range wanted {
+		mask |= os.FileMode(entry.Perm)
+	}
+
+	// Same as setACLMain
+	if entries, err := readACL(path); err == nil {
+		setACLMode(entries, mode)
+		if merged, err := mergeACL(entries, wanted); err == nil {
+			for _, entry := range merged {
+				if entry.Tag == aclMask {
+					mask = os.FileMode(entry.Perm)
+				}
+			}
+		}
+	}
+
+	return mode&^0070 | mask<<3
+}
+
+// attrCommand returns the pets command setting ACLs or xattrs.
+func attrCommand(args ...string) *exec.Cmd {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	cmd := NewCmd(append([]string{self, AttrCommand}, args...))
+
+	// Users and groups are looked up in the alternate root
+	if RootDir != "" {
+		cmd.Env = append(os.Environ(), "PETS_ROOT="+RootDir)
+	}
+
+	return cmd
+}
+
+// SetACL returns an ACL PetsAction if the ACL of the file lacks any of the
+// requested entries, nil otherwise.
+func SetACL(trigger *PetsFile) *PetsAction {
+	if len(trigger.ACL) == 0 || trigger.Dest == "" || trigger.Absent || trigger.Link {
+		return nil
+	}
+
+	if symlinkAtDest(trigger) && !trigger.Force {
+		log.Printf("[ERROR] %s is a symbolic link, not changing the ACL of its target\n", trigger.Dest)
+		return nil
+	}
+
+	// Owner, group and other permissions are part of the ACL, set them
+	// along with the named entries. See Chmod.
+	args := []string{"acl"}
+	if trigger.Mode != "" {
+		args = append(args, "-mode", trigger.Mode)
+	}
+
+	args = append(args, trigger.Dest)
+	for _, entry := range trigger.ACL {
+		args = append(args, entry.String())
+	}
+
+	action := &PetsAction{
+		Cause:   ACL,
+		Command: attrCommand(args...),
+		Trigger: trigger,
+	}
+
+	entries, err := readACL(trigger.Dest)
+	if os.IsNotExist(err) || symlinkAtDest(trigger) {
+		// The file is going to be created
+		return action
+	} else if err != nil {
+		log.Printf("[ERROR] cannot read ACL of %s: %v\n", trigger.Dest, err)
+		return action
+	}
+
+	for _, entry := range trigger.ACL {
+		has, err := aclHas(entries, entry)
+		if err != nil {
+			log.Printf("[INFO] %s: %v yet, set ACL later on\n", trigger.Dest, err)
+			return action
+		}
+
+		if !has {
+			log.Printf("[INFO] ACL of %s lacks %s\n", trigger.Dest, entry)
+			return action
+		}
+	}
+
+	if mode, err := StringToFileMode(trigger.Mode); trigger.Mode != "" && err == nil && !aclHasMode(entries, mode) {
+		log.Printf("[INFO] ACL of %s does not match mode %s\n", trigger.Dest, trigger.Mode)
+		return action
+	}
+
+	log.Printf("[DEBUG] ACL of %s is fine already\n", trigger.Dest)
+	return nil
+}
+
+// SetXattrs returns an XATTR PetsAction for each extended attribute of the
+// file which is missing or has a different value.
+func SetXattrs(trigger *PetsFile) []*PetsAction {
+	actions := []*PetsAction{}
+
+	if len(trigger.Xattrs) == 0 || trigger.Dest == "" || trigger.Absent || trigger.Link {
+		return actions
+	}
+
+	replaced := symlinkAtDest(trigger)
+	if replaced && !trigger.Force {
+		log.Printf("[ERROR] %s is a symbolic link, not changing the xattrs of its target\n", trigger.Dest)
+		return actions
+	}
+
+	for _, xattr := range trigger.Xattrs {
+		value, found, err := getXattr(trigger.Dest, xattr.Name)
+		if replaced {
+			// Not the file to be copied, which does not exist yet
+			value, found, err = nil, false, os.ErrNotExist
+		}
+
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[ERROR] cannot read xattr %s of %s: %v\n", xattr.Name, trigger.Dest, err)
+		} else if found && bytes.Equal(value, xattr.Value) {
+			log.Printf("[DEBUG] xattr %s of %s is fine already\n", xattr.Name, trigger.Dest)
+			continue
+		} else if err == nil {
+			log.Printf("[INFO] xattr %s of %s is %q instead of %q\n", xattr.Name, trigger.Dest, value, xattr.Value)
+		}
+
+		actions = append(actions, &PetsAction{
+			Cause:   XATTR,
+			Command: attrCommand("xattr", trigger.Dest, xattr.Name, "0x"+hex.EncodeToString(xattr.Value)),
+			Trigger: trigger,
+		})
+	}
+
+	return actions
+}
+
+// SetAttrMain implements the hidden set-attr command. The arguments are either
+// "acl", optionally "-mode" and the mode to set, the path and the ACL entries
+// to add, or "xattr", the path, the name and the hex-encoded value of the
+// extended attribute. The return value is the exit status.
+func SetAttrMain(args []string) int {
+	mode := ""
+	if len(args) > 2 && args[0] == "acl" && args[1] == "-mode" {
+		mode = args[2]
+		args = append([]string{args[0]}, args[3:]...)
+	}
+
+	if len(args) < 3 || (args[0] == "xattr" && len(args) != 4) {
+		fmt.Fprintf(os.Stderr, "usage: %s acl [-mode MODE] PATH ENTRY... | xattr PATH NAME HEXVALUE\n", AttrCommand)
+		return 2
+	}
+
+	RootDir = os.Getenv("PETS_ROOT")
+	path := args[1]
+
+	var err error
+
+	switch args[0] {
+	case "acl":
+		err = setACLMain(path, mode, args[2:])
+	case "xattr":
+		var value []byte
+		value, err = hex.DecodeString(strings.TrimPrefix(args[3], "0x"))
+		if err == nil {
+			err = lsetxattr(path, args[2], value)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown attribute type '%s'\n", args[0])
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	return 0
+}
+
+// setACLMain adds the given entries to the ACL of path, and sets the owner,
+// owning group and other permissions to those in mode unless it is empty.
+func setACLMain(path, mode string, texts []string) error {
+	wanted := []PetsACLEntry{}
+	for _, text := range texts {
+		entry, err := ParseACLEntry(text)
+		if err != nil {
+			return err
+		}
+		wanted = append(wanted, entry)
+	}
+
+	entries, err := readACL(path)
+	if err != nil {
+		return err
+	}
+
+	if mode != "" {
+		fileMode, err := StringToFileMode(mode)
+		if err != nil {
+			return err
+		}
+		setACLMode(entries, fileMode)
+	}
+
+	entries, err = mergeACL(entries, wanted)
+	if err != nil {
+		return err
+	}
+
+	return writeACL(path, entries)
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseACLEntry(t *testing.T) {
+	entry, err := ParseACLEntry("g:monitoring:r")
+	assertNoError(t, err)
+	assertEquals(t, entry.String(), "group:monitoring:r--")
+
+	entry, err = ParseACLEntry("user:backup:r-x")
+	assertNoError(t, err)
+	assertEquals(t, entry.Perm, uint16(5))
+
+	_, err = ParseACLEntry("other::r")
+	assertError(t, err)
+	_, err = ParseACLEntry("user::rw")
+	assertError(t, err)
+	_, err = ParseACLEntry("user:backup:rwz")
+	assertError(t, err)
+}
+
+func TestAddXattr(t *testing.T) {
+	pf := NewPetsFile()
+	assertNoError(t, pf.AddXattr("user.comment=managed by pets"))
+	assertNoError(t, pf.AddXattr("security.capability=0x0100000200200000"))
+	assertEquals(t, len(pf.Xattrs), 2)
+	assertEquals(t, string(pf.Xattrs[0].Value), "managed by pets")
+	assertEquals(t, len(pf.Xattrs[1].Value), 8)
+
+	assertError(t, pf.AddXattr("comment=nope"))
+	assertError(t, pf.AddXattr("system.posix_acl_access=0x02"))
+	assertError(t, pf.AddXattr("user.hex=0xzz"))
+}
+
+func TestMergeACL(t *testing.T) {
+	entries := []aclEntry{
+		{Tag: aclUserObj, Perm: 6},
+		{Tag: aclGroupObj, Perm: 4},
+		{Tag: aclOther, Perm: 0},
+	}
+
+	wanted := []PetsACLEntry{{Tag: "group", Name: "31337", Perm: 4}, {Tag: "user", Name: "31338", Perm: 7}}
+
+	merged, err := mergeACL(entries, wanted)
+	assertNoError(t, err)
+	assertEquals(t, len(merged), 6)
+	assertEquals(t, merged[1], aclEntry{Tag: aclUser, Perm: 7, Id: 31338})
+	assertEquals(t, merged[3], aclEntry{Tag: aclGroup, Perm: 4, Id: 31337})
+	assertEquals(t, merged[4], aclEntry{Tag: aclMask, Perm: 7})
+
+	has, err := aclHas(merged, wanted[0])
+	assertNoError(t, err)
+	assertEquals(t, has, true)
+
+	// Limited by the mask
+	merged[4].Perm = 0
+	has, err = aclHas(merged, wanted[0])
+	assertNoError(t, err)
+	assertEquals(t, has, false)
+}
+
+func TestSetAttrs(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "app.log")
+	assertNoError(t, os.WriteFile(dest, []byte{}, 0640))
+
+	if err := writeACL(dest, []aclEntry{{Tag: aclUserObj, Perm: 6}, {Tag: aclGroupObj, Perm: 4}, {Tag: aclOther, Perm: 0}}); err != nil {
+		t.Skipf("ACLs not supported: %v", err)
+	}
+
+	pf := NewPetsFile()
+	pf.Source = "/dev/null"
+	pf.AddDest(dest)
+	assertNoError(t, pf.AddACL("group:"+strconv.Itoa(os.Getgid())+":r"))
+	assertNoError(t, pf.AddACL("u:31337:rw"))
+	assertNoError(t, pf.AddXattr("user.comment=managed by pets"))
+
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, actions[0].Cause.String(), "ACL")
+	assertEquals(t, actions[1].Cause.String(), "XATTR")
+
+	assertEquals(t, RunActions(actions), 0)
+
+	value, found, err := getXattr(dest, "user.comment")
+	assertNoError(t, err)
+	assertEquals(t, found, true)
+	assertEquals(t, string(value), "managed by pets")
+
+	entries, err := readACL(dest)
+	assertNoError(t, err)
+	assertEquals(t, len(entries), 6)
+
+	// Nothing left to do
+	assertEquals(t, len(NewPetsActions([]*PetsFile{pf})), 0)
+
+	// Wrong usage
+	assertEquals(t, SetAttrMain([]string{"xattr", dest}), 2)
+	assertEquals(t, SetAttrMain([]string{"frobnicate", dest, "x"}), 2)
+}
+
+func TestACLWithMode(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "app.conf")
+	assertNoError(t, os.WriteFile(dest, []byte{}, 0600))
+
+	if err := writeACL(dest, []aclEntry{{Tag: aclUserObj, Perm: 6}, {Tag: aclGroupObj, Perm: 0}, {Tag: aclOther, Perm: 0}}); err != nil {
+		t.Skipf("ACLs not supported: %v", err)
+	}
+
+	assertEquals(t, ACLMode("/nonexistent", 0640, []PetsACLEntry{{Tag: "user", Name: "31337", Perm: 6}}), os.FileMode(0660))
+	assertEquals(t, ACLMode("/nonexistent", 0750, []PetsACLEntry{{Tag: "user", Name: "31337", Perm: 4}}), os.FileMode(0750))
+
+	pf := NewPetsFile()
+	pf.Source = "/dev/null"
+	pf.AddDest(dest)
+	assertNoError(t, pf.AddMode("0640"))
+	assertNoError(t, pf.AddACL("u:31337:rw"))
+
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, actions[0].Cause.String(), "CHMOD")
+	assertEquals(t, actions[0].Command.Args[1], "0660")
+	assertEquals(t, actions[1].Cause.String(), "ACL")
+	assertEquals(t, RunActions(actions), 0)
+
+	// Applying the plan again changes nothing
+	assertEquals(t, len(NewPetsActions([]*PetsFile{pf})), 0)
+
+	entries, err := readACL(dest)
+	assertNoError(t, err)
+	for _, entry := range entries {
+		if entry.Tag == aclGroupObj {
+			assertEquals(t, entry.Perm, uint16(4))
+		}
+	}
+
+	// A different mode changes the owning group in the ACL
+	assertNoError(t, pf.AddMode("0600"))
+	actions = NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 1)
+	assertEquals(t, actions[0].Cause.String(), "ACL")
+	assertEquals(t, RunActions(actions), 0)
+	assertEquals(t, len(NewPetsActions([]*PetsFile{pf})), 0)
+
+	// Other named entries are part of the mask too
+	entries, err = readACL(dest)
+	assertNoError(t, err)
+	entries, err = mergeACL(entries, []PetsACLEntry{{Tag: "user", Name: "31338", Perm: 7}})
+	assertNoError(t, err)
+	assertNoError(t, writeACL(dest, entries))
+	assertEquals(t, ACLMode(dest, 0600, pf.ACL), os.FileMode(0670))
+
+	actions = NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 0)
+
+	// Symbolic links are never followed
+	link := filepath.Join(filepath.Dir(dest), "link")
+	assertNoError(t, os.Symlink(dest, link))
+	assertEquals(t, SetAttrMain([]string{"xattr", link, "user.comment", "0x00"}), 1)
+	_, found, err := getXattr(dest, "user.comment")
+	assertNoError(t, err)
+	assertEquals(t, found, false)
+}
@@ -3,11 +3,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -17,19 +19,69 @@ type PetsFile struct {
 	// Absolute path to the configuration file
 	Source string
 	Pkgs   []PetsPackage
-	// Full destination path where the file has to be installed
+	// Packages that must not be installed
+	AbsentPkgs []PetsPackage
+	// Full destination path where the file has to be installed, under
+	// RootDir if an alternate root is used
 	Dest string
 	// Directory where the file has to be installed. This is only set in
 	// case we have to create the destination directory
 	Directory string
-	User      *user.User
-	Group     *user.Group
+	// Names given with the 'owner' and 'group' directives. They are
+	// resolved to User and Group as soon as the accounts exist, which may
+	// only happen once packages are installed. See ResolveOwner.
+	Owner      string
+	OwnerGroup string
+	User       *user.User
+	Group      *user.Group
+	// Like Owner, OwnerGroup, User, Group and Mode, but for the directories
+	// created to install the file
+	DirOwner      string
+	DirOwnerGroup string
+	DirUser       *user.User
+	DirGroup      *user.Group
+	DirMode       string
+	// Apply the above to Directory even if it exists already
+	DirEnforce bool
 	// use string instead of os.FileMode to avoid converting back and forth
 	Mode string
-	Pre  *exec.Cmd
-	Post *exec.Cmd
+	// Named entries of the access ACL, and extended attributes, see attr.go
+	ACL    []PetsACLEntry
+	Xattrs []PetsXattr
+	Pre    *exec.Cmd
+	Post   *exec.Cmd
+	// Run Post right after this file is updated, instead of once at the end
+	// of the pets run
+	PostImmediate bool
+	// Command to run if this file cannot be applied
+	OnFail *exec.Cmd
+	// Apply this file, and install its packages, before the packages of all
+	// other files. See IsEarly.
+	Early bool
 	// Is this a symbolic link or an actual file to be copied?
 	Link bool
+	// Dest must not exist, and is moved to BackupDir if it does
+	Absent bool
+	// Move anything else at Dest to BackupDir to create the symbolic link,
+	// or a symbolic link at Dest to copy the file
+	Force bool
+	// Point the symbolic link to Source relative to the directory of Dest,
+	// so that it survives moving the configuration directory along with it
+	Relative bool
+	// Other pets files that must be applied before this one, referenced by
+	// source or destination path
+	After []string
+	// Like After, but this file is also skipped if any of them fails
+	Requires []string
+	// The pets files referenced by After and Requires, filled by the
+	// validator. RequiredFiles is a subset of AfterFiles.
+	AfterFiles    []*PetsFile
+	RequiredFiles []*PetsFile
+	// Local user and group that must exist, see account.go
+	Account      *PetsUser
+	AccountGroup *PetsGroup
+	// Services that must be in a given state, see service.go
+	Services []PetsService
 }
 
 func NewPetsFile() *PetsFile {
@@ -44,7 +96,7 @@ func NewPetsFile() *PetsFile {
 // NeedsCopy returns PetsCause UPDATE if Source needs to be copied over Dest,
 // CREATE if the Destination file does not exist yet, NONE otherwise.
 func (pf *PetsFile) NeedsCopy() PetsCause {
-	if pf.Link || pf.Source == "" {
+	if pf.Link || pf.Absent || pf.Source == "" || pf.Dest == "" {
 		return NONE
 	}
 
@@ -54,6 +106,19 @@ func (pf *PetsFile) NeedsCopy() PetsCause {
 		return NONE
 	}
 
+	// Copying over a symbolic link would overwrite its target instead. The
+	// link is moved out of the way with force, see FileToReplace. Links
+	// into the configuration directory are refused by CheckConfDir.
+	if isSymlink(pf.Dest) {
+		if !pf.Force {
+			log.Printf("[ERROR] %s is a symbolic link, not overwriting its target\n", pf.Dest)
+			return NONE
+		}
+
+		log.Printf("[INFO] replacing symbolic link %s with %s\n", pf.Dest, pf.Source)
+		return REPLACE
+	}
+
 	shaDest, err := Sha256(pf.Dest)
 	if os.IsNotExist(err) {
 		return CREATE
@@ -75,7 +140,7 @@ func (pf *PetsFile) NeedsCopy() PetsCause {
 // and Dest as LINK_NAME needs to be created. See ln(1) for the most confusing
 // terminology.
 func (pf *PetsFile) NeedsLink() PetsCause {
-	if !pf.Link || pf.Source == "" || pf.Dest == "" {
+	if !pf.Link || pf.Absent || pf.Source == "" || pf.Dest == "" {
 		return NONE
 	}
 
@@ -103,29 +168,66 @@ func (pf *PetsFile) NeedsLink() PetsCause {
 
 	// Easy case first: Dest exists and it is not a symlink
 	if fi.Mode()&os.ModeSymlink == 0 {
+		if pf.Force {
+			log.Printf("[INFO] %s already exists, replacing it\n", pf.Dest)
+			return REPLACE
+		}
 		log.Printf("[ERROR] %s already exists\n", pf.Dest)
 		return NONE
 	}
 
-	// Dest is a symlink
-	path, err := filepath.EvalSymlinks(pf.Dest)
+	// Dest is a symlink. Compare its target rather than the fully evaluated
+	// path: Source may be reached through other symlinks, and a relative
+	// link must stay relative.
+	target, err := os.Readlink(pf.Dest)
 
-	if err != nil {
-		log.Printf("[ERROR] cannot EvalSymlinks() Dest file %s: %v\n", pf.Dest, err)
-	} else if pf.Source == path {
+	if err == nil && target == pf.LinkTarget() {
 		// Happy path
-		log.Printf("[DEBUG] %s is a symlink to %s already\n", pf.Dest, pf.Source)
+		log.Printf("[DEBUG] %s is a symlink to %s already\n", pf.Dest, target)
+		return NONE
+	}
+
+	// Wrong symlink
+	if pf.Force {
+		log.Printf("[INFO] %s is a symlink to something else, replacing it\n", pf.Dest)
+		return REPLACE
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] cannot readlink Dest file %s: %v\n", pf.Dest, err)
 	} else {
-		log.Printf("[ERROR] %s is a symlink to %s instead of %s\n", pf.Dest, path, pf.Source)
+		log.Printf("[ERROR] %s is a symlink to %s instead of %s\n", pf.Dest, target, pf.LinkTarget())
 	}
 	return NONE
 }
 
+// LinkTarget returns the TARGET of the symbolic link to create at Dest: Source
+// itself, or the path to Source relative to the directory of Dest if Relative
+// is set. With an alternate root, targets are as seen from within the root,
+// which IsValid requires Source to be in.
+func (pf *PetsFile) LinkTarget() string {
+	dest := strings.TrimPrefix(pf.Dest, RootDir)
+	source := strings.TrimPrefix(pf.Source, RootDir)
+
+	if !pf.Relative {
+		return source
+	}
+
+	target, err := filepath.Rel(filepath.Dir(dest), source)
+	if err != nil {
+		// Both paths are absolute, this cannot really happen
+		log.Printf("[ERROR] cannot make %s relative to %s: %v\n", pf.Source, pf.Dest, err)
+		return pf.Source
+	}
+
+	return target
+}
+
 // NeedsDir returns PetsCause DIR if there is no directory at Directory,
 // meaning that it has to be created. Most of this is suspiciously similar to
 // NeedsLink above.
 func (pf *PetsFile) NeedsDir() PetsCause {
-	if pf.Directory == "" {
+	if pf.Directory == "" || pf.Absent {
 		return NONE
 	}
 
@@ -157,7 +259,64 @@ func (pf *PetsFile) NeedsDir() PetsCause {
 	return NONE
 }
 
+// NeedsDelete returns PetsCause DELETE if Dest has to be absent but it is
+// there, NONE otherwise.
+func (pf *PetsFile) NeedsDelete() PetsCause {
+	if !pf.Absent || pf.Dest == "" {
+		return NONE
+	}
+
+	_, err := os.Lstat(pf.Dest)
+
+	if os.IsNotExist(err) {
+		log.Printf("[DEBUG] %s is absent already\n", pf.Dest)
+		return NONE
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] cannot lstat Dest file %s: %v\n", pf.Dest, err)
+		return NONE
+	}
+
+	return DELETE
+}
+
 func (pf *PetsFile) IsValid(pathErrorOK bool) bool {
+	if _, none := WhichPackageManager().(*NoPackageManager); none && len(pf.Pkgs)+len(pf.AbsentPkgs) > 0 {
+		log.Printf("[ERROR] %s has package directives, but there is no package manager\n", pf.Source)
+		return false
+	}
+
+	// Pinned versions would never be installed, and planned again on every
+	// run
+	if pacman, ok := WhichPackageManager().(*Pacman); ok && anyVersion(pf.Pkgs) {
+		log.Printf("[ERROR] %s pins package versions, which %s cannot install\n", pf.Source, pacman.Command)
+		return false
+	}
+
+	if !servicesSupported(pf) {
+		return false
+	}
+
+	// Symbolic links have no mode, and Linux does not support ACLs or
+	// user xattrs on them: we would change the file they point to
+	if pf.Link && (pf.Mode != "" || len(pf.ACL) > 0 || len(pf.Xattrs) > 0) {
+		log.Printf("[ERROR] %s: mode, acl and xattr cannot be used with symlink\n", pf.Source)
+		return false
+	}
+
+	// A link out of the root would be dangling once the root is in use, see
+	// LinkTarget
+	if pf.Link && RootDir != "" && !inDir(pf.Source, RootDir) {
+		log.Printf("[ERROR] %s: symlink to a file outside of root %s\n", pf.Source, RootDir)
+		return false
+	}
+
+	if pf.RefusesSymlink() {
+		log.Printf("[ERROR] %s: %s is a symbolic link, set force to replace it\n", pf.Source, pf.Dest)
+		return false
+	}
+
 	// Check if the specified package(s) exists
 	for _, pkg := range pf.Pkgs {
 		if !pkg.IsValid() {
@@ -174,36 +333,178 @@ func (pf *PetsFile) IsValid(pathErrorOK bool) bool {
 }
 
 func (pf *PetsFile) AddDest(dest string) {
-	pf.Dest = dest
-	pf.Directory = filepath.Dir(dest)
+	pf.Dest = RootPath(dest)
+	pf.Directory = filepath.Dir(pf.Dest)
+}
+
+// AddAbsent sets the path which must not exist.
+func (pf *PetsFile) AddAbsent(dest string) {
+	pf.AddDest(dest)
+	pf.Absent = true
+}
+
+// RefusesSymlink returns true if the file cannot be applied because of the
+// symbolic link at Dest: copying over it would overwrite its target instead.
+// Unlike other invalid files, such files count as failed.
+func (pf *PetsFile) RefusesSymlink() bool {
+	return pf.Source != "" && !pf.Force && symlinkAtDest(pf)
+}
+
+// AddForce sets whether anything at Dest can be replaced by the symbolic link,
+// or a symbolic link at Dest by the file.
+func (pf *PetsFile) AddForce(value string) error {
+	force, err := strconv.ParseBool(value)
+	if err == nil {
+		pf.Force = force
+	}
+	return err
+}
+
+// AddRelative sets whether the symbolic link points to Source with a relative
+// path.
+func (pf *PetsFile) AddRelative(value string) error {
+	relative, err := strconv.ParseBool(value)
+	if err == nil {
+		pf.Relative = relative
+	}
+	return err
+}
+
+// AddState sets whether Dest has to be present, the default, or absent.
+func (pf *PetsFile) AddState(state string) error {
+	switch state {
+	case "present":
+		pf.Absent = false
+	case "absent":
+		pf.Absent = true
+	default:
+		return fmt.Errorf("invalid state '%s'", state)
+	}
+	return nil
 }
 
 func (pf *PetsFile) AddLink(dest string) {
-	pf.Dest = dest
-	pf.Directory = filepath.Dir(dest)
+	pf.Dest = RootPath(dest)
+	pf.Directory = filepath.Dir(pf.Dest)
 	pf.Link = true
 }
 
-func (pf *PetsFile) AddUser(userName string) error {
-	user, err := user.Lookup(userName)
-	if err != nil {
-		// TODO: one day we may add support for creating users
+// AddUser sets the owner of the file. The user does not need to exist yet,
+// as it may be created by a package or by a 'user' directive.
+func (pf *PetsFile) AddUser(userName string) {
+	pf.Owner = userName
+	pf.User = nil
+
+	if user, err := LookupUser(userName); err == nil {
+		pf.User = user
+	} else {
+		log.Printf("[DEBUG] owner %s of %s not found yet\n", userName, pf.Source)
+	}
+}
+
+// AddGroup is the AddUser counterpart for the group owning the file.
+func (pf *PetsFile) AddGroup(groupName string) {
+	pf.OwnerGroup = groupName
+	pf.Group = nil
+
+	if group, err := LookupGroup(groupName); err == nil {
+		pf.Group = group
+	} else {
+		log.Printf("[DEBUG] group %s of %s not found yet\n", groupName, pf.Source)
+	}
+}
+
+// ResolveOwner looks up the owner and group of the file, if that was not
+// possible before. An error is returned if they still do not exist.
+func (pf *PetsFile) ResolveOwner() error {
+	if err := resolveUser(pf.Owner, &pf.User); err != nil {
+		return err
+	}
+
+	return resolveGroup(pf.OwnerGroup, &pf.Group)
+}
+
+// ResolveDirOwner is the ResolveOwner counterpart for the owner and group of
+// the directory.
+func (pf *PetsFile) ResolveDirOwner() error {
+	if err := resolveUser(pf.DirOwner, &pf.DirUser); err != nil {
 		return err
 	}
-	pf.User = user
+
+	return resolveGroup(pf.DirOwnerGroup, &pf.DirGroup)
+}
+
+// resolveUser looks up the given user name, unless it is empty or found
+// already, and stores the result in found.
+func resolveUser(name string, found **user.User) error {
+	if name == "" || *found != nil {
+		return nil
+	}
+
+	user, err := LookupUser(name)
+	if err != nil {
+		return fmt.Errorf("unknown owner %s", name)
+	}
+
+	*found = user
 	return nil
 }
 
-func (pf *PetsFile) AddGroup(groupName string) error {
-	group, err := user.LookupGroup(groupName)
+// resolveGroup is the resolveUser counterpart for groups.
+func resolveGroup(name string, found **user.Group) error {
+	if name == "" || *found != nil {
+		return nil
+	}
+
+	group, err := LookupGroup(name)
 	if err != nil {
-		// TODO: one day we may add support for creating groups
+		return fmt.Errorf("unknown group %s", name)
+	}
+
+	*found = group
+	return nil
+}
+
+// AddDirUser sets the owner of the directories created for the file, which
+// may not exist yet, like in AddUser.
+func (pf *PetsFile) AddDirUser(userName string) {
+	pf.DirOwner = userName
+	pf.DirUser = nil
+
+	if err := resolveUser(userName, &pf.DirUser); err != nil {
+		log.Printf("[DEBUG] directory owner %s of %s not found yet\n", userName, pf.Source)
+	}
+}
+
+// AddDirGroup sets the group of the directories created for the file.
+func (pf *PetsFile) AddDirGroup(groupName string) {
+	pf.DirOwnerGroup = groupName
+	pf.DirGroup = nil
+
+	if err := resolveGroup(groupName, &pf.DirGroup); err != nil {
+		log.Printf("[DEBUG] directory group %s of %s not found yet\n", groupName, pf.Source)
+	}
+}
+
+// AddDirMode sets the mode of the directories created for the file.
+func (pf *PetsFile) AddDirMode(mode string) error {
+	if _, err := StringToFileMode(mode); err != nil {
 		return err
 	}
-	pf.Group = group
+	pf.DirMode = mode
 	return nil
 }
 
+// AddDirEnforce sets whether the directory settings apply to an existing
+// Directory too.
+func (pf *PetsFile) AddDirEnforce(value string) error {
+	enforce, err := strconv.ParseBool(value)
+	if err == nil {
+		pf.DirEnforce = enforce
+	}
+	return err
+}
+
 func (pf *PetsFile) AddMode(mode string) error {
 	_, err := StringToFileMode(mode)
 	if err == nil {
@@ -213,6 +514,100 @@ func (pf *PetsFile) AddMode(mode string) error {
 	return err
 }
 
+func (pf *PetsFile) AddPostImmediate(value string) error {
+	immediate, err := strconv.ParseBool(value)
+	if err == nil {
+		pf.PostImmediate = immediate
+	}
+	return err
+}
+
+func (pf *PetsFile) AddOnFail(onFail string) {
+	onFailArgs := strings.Fields(onFail)
+	if len(onFailArgs) > 0 {
+		pf.OnFail = NewCmd(onFailArgs)
+	}
+}
+
+// RunOnFail runs the 'onfail' command of this file, if any. The reason of the
+// failure is passed to the command via the environment variables PETS_CAUSE
+// and PETS_ERROR. PETS_SOURCE and PETS_DEST are set too.
+func (pf *PetsFile) RunOnFail(cause string, failure error) {
+	if pf.OnFail == nil {
+		return
+	}
+
+	// The command would run on the live system instead of the alternate
+	// root
+	if RootDir != "" {
+		log.Printf("[INFO] not running onfail command '%s' of %s in %s\n", pf.OnFail, pf.Source, RootDir)
+		return
+	}
+
+	// Use a new command, as the file can fail more than once
+	onFail := NewCmd(pf.OnFail.Args)
+	onFail.Env = append(os.Environ(),
+		"PETS_CAUSE="+cause,
+		fmt.Sprintf("PETS_ERROR=%v", failure),
+		"PETS_SOURCE="+pf.Source,
+		"PETS_DEST="+pf.Dest)
+
+	log.Printf("[INFO] running onfail command '%s'\n", onFail)
+
+	stdout, stderr, err := RunCmd(onFail)
+
+	if err != nil {
+		log.Printf("[ERROR] onfail command %s: %s\n", onFail, err)
+	}
+
+	if len(stdout) > 0 {
+		log.Printf("[INFO] stdout: %s", stdout)
+	}
+
+	if len(stderr) > 0 {
+		log.Printf("[ERROR] stderr: %s", stderr)
+	}
+}
+
+// AddPhase sets the phase this file belongs to, either "early" or "normal".
+func (pf *PetsFile) AddPhase(phase string) error {
+	switch phase {
+	case "early":
+		pf.Early = true
+	case "normal":
+		pf.Early = false
+	default:
+		return fmt.Errorf("unknown phase '%s'", phase)
+	}
+	return nil
+}
+
+// IsEarly returns true if this file has to be applied before installing
+// packages, either because it was asked to or because it configures package
+// repositories.
+func (pf *PetsFile) IsEarly() bool {
+	return pf.Early || (pf.Dest != "" && IsRepositoryFile(pf.Dest))
+}
+
+func (pf *PetsFile) AddAfter(ref string) {
+	pf.After = append(pf.After, ref)
+}
+
+func (pf *PetsFile) AddRequires(ref string) {
+	pf.Requires = append(pf.Requires, ref)
+}
+
+// AddVersion sets the wanted version of the package added last.
+func (pf *PetsFile) AddVersion(version string) error {
+	if len(pf.Pkgs) == 0 {
+		return fmt.Errorf("version %s given before any package", version)
+	}
+
+	last := len(pf.Pkgs) - 1
+	pf.Pkgs[last] = PetsPackage(pf.Pkgs[last].Name() + "=" + version)
+	return nil
+}
+
 func (pf *PetsFile) AddPre(pre string) {
 	preArgs := strings.Fields(pre)
 	if len(preArgs) > 0 {
@@ -3,6 +3,9 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -26,6 +29,31 @@ func TestBadGroup(t *testing.T) {
 	}
 }
 
+func TestUnknownOwner(t *testing.T) {
+	pf := NewPetsFile()
+	pf.AddDest("/etc/postfix/main.cf")
+	pf.AddUser("never-did-this-user-exist")
+	pf.AddGroup("never-did-this-group-exist")
+
+	// Kept by name until the accounts exist
+	assertEquals(t, pf.Owner, "never-did-this-user-exist")
+	assertEquals(t, pf.User == nil, true)
+	assertError(t, pf.ResolveOwner())
+
+	pa := Chown(pf)
+	assertEquals(t, pa.Command.String(), "/bin/chown never-did-this-user-exist:never-did-this-group-exist /etc/postfix/main.cf")
+
+	// Not known yet under the alternate root, chown from within it
+	withRootDir(t, newTestRoot(t))
+	pf.AddDest("/etc/postfix/main.cf")
+	pf.AddUser("turner")
+	pf.AddGroup("pirates")
+	assertEquals(t, pf.Group.Gid, "4243")
+
+	pa = Chown(pf)
+	assertEquals(t, strings.Join(pa.Command.Args[2:], " "), "/bin/chown turner:pirates /etc/postfix/main.cf")
+}
+
 func TestShortModes(t *testing.T) {
 	f, err := NewTestFile("", "", "", "root", "root", "600", "", "")
 
@@ -129,6 +157,48 @@ func TestNeedsLinkDestIsSymlink(t *testing.T) {
 	assertEquals(t, int(f.NeedsLink()), int(NONE))
 }
 
+func TestNeedsLinkRelative(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	f := NewPetsFile()
+	f.Source = tmpDir + "/pets/vimrc"
+	f.AddLink(tmpDir + "/home/.vimrc")
+	assertNoError(t, f.AddRelative("true"))
+	assertEquals(t, f.LinkTarget(), "../pets/vimrc")
+
+	assertNoError(t, os.MkdirAll(tmpDir+"/home", 0755))
+	assertNoError(t, os.Symlink("../pets/vimrc", f.Dest))
+
+	// Link targets are compared, even if Source does not exist
+	assertEquals(t, int(f.NeedsLink()), int(NONE))
+
+	// An absolute link to Source is not what was asked for
+	assertNoError(t, f.AddRelative("false"))
+	assertEquals(t, f.LinkTarget(), f.Source)
+	assertNoError(t, f.AddForce("true"))
+	assertEquals(t, int(f.NeedsLink()), int(REPLACE))
+
+	assertError(t, f.AddRelative("sometimes"))
+
+	// With an alternate root, the configuration directory has to be in it
+	withRootDir(t, tmpDir+"/root")
+	f.Source = tmpDir + "/root/srv/pets/vimrc"
+	f.AddLink("/etc/vim/vimrc.local")
+	assertNoError(t, f.AddRelative("true"))
+	assertEquals(t, f.LinkTarget(), "../../srv/pets/vimrc")
+	assertEquals(t, f.IsValid(true), true)
+
+	// Absolute links too
+	assertNoError(t, f.AddRelative("false"))
+	assertEquals(t, f.LinkTarget(), "/srv/pets/vimrc")
+	assertEquals(t, f.IsValid(true), true)
+
+	f.Source = tmpDir + "/pets/vimrc"
+	assertEquals(t, f.IsValid(true), false)
+	assertNoError(t, f.AddRelative("true"))
+	assertEquals(t, f.IsValid(true), false)
+}
+
 func TestNeedsDirNoDirectory(t *testing.T) {
 	f := NewPetsFile()
 	assertEquals(t, int(f.NeedsDir()), int(NONE))
@@ -151,3 +221,34 @@ func TestNeedsDirDestIsFile(t *testing.T) {
 	f.Directory = "/etc/passwd"
 	assertEquals(t, int(f.NeedsDir()), int(NONE))
 }
+
+func TestRunOnFail(t *testing.T) {
+	out := t.TempDir() + "/onfail"
+
+	f := NewPetsFile()
+	f.Source = "sample_pet/vimrc"
+	f.AddDest("/root/.vimrc")
+
+	// No onfail directive, nothing to do
+	f.RunOnFail("FILE_UPDATE", fmt.Errorf("polpette"))
+
+	f.AddOnFail("/bin/sh -c env>" + out)
+	f.RunOnFail("FILE_UPDATE", fmt.Errorf("polpette"))
+
+	env, err := os.ReadFile(out)
+	assertNoError(t, err)
+
+	for _, expected := range []string{"PETS_CAUSE=FILE_UPDATE", "PETS_ERROR=polpette", "PETS_SOURCE=sample_pet/vimrc", "PETS_DEST=/root/.vimrc"} {
+		if !strings.Contains(string(env), expected+"\n") {
+			t.Errorf("Expecting %s in onfail environment, got %s instead", expected, env)
+		}
+	}
+
+	// Failing again runs the command again
+	assertNoError(t, os.Remove(out))
+	f.RunOnFail("POST", fmt.Errorf("polpette"))
+
+	env, err = os.ReadFile(out)
+	assertNoError(t, err)
+	assertEquals(t, strings.Contains(string(env), "PETS_CAUSE=POST\n"), true)
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,16 +13,83 @@ import (
 	"github.com/hashicorp/logutils"
 )
 
-// ParseFlags parses the CLI flags and returns: the configuration directory as
-// string, a bool for debugging output, and another bool for dryRun.
-func ParseFlags() (string, bool, bool) {
-	var confDir string
+// PetsOptions holds the settings passed on the command line.
+type PetsOptions struct {
+	// Configuration directory
+	ConfDir string
+	// Show debugging output
+	Debug bool
+	// Only show changes without applying them
+	DryRun bool
+	// Output format: "text" or "json"
+	Output string
+	// Subcommand: "plan", "apply", or empty for a regular run
+	Command string
+	// Plan file written by "plan" and read by "apply"
+	PlanFile string
+	// Plan again instead of failing if the plan to apply is stale
+	Replan bool
+	// Package manager to use instead of detecting it
+	PackageManager string
+	// State file of the fake package manager, if it should be used
+	FakePackages string
+	// Alternate root directory to configure instead of the live system
+	Root string
+	// Refresh the package cache before installing packages if older
+	MaxCacheAge time.Duration
+}
+
+// ParseFlags parses the CLI flags and returns them as PetsOptions. The
+// optional "plan" and "apply" subcommands, with their own flags, follow the
+// global ones.
+func ParseFlags() *PetsOptions {
+	opts := &PetsOptions{}
 	defaultConfDir := filepath.Join(os.Getenv("HOME"), "pets")
-	flag.StringVar(&confDir, "conf-dir", defaultConfDir, "Pets configuration directory")
-	debug := flag.Bool("debug", false, "Show debugging output")
-	dryRun := flag.Bool("dry-run", false, "Only show changes without applying them")
+	flag.StringVar(&opts.ConfDir, "conf-dir", defaultConfDir, "Pets configuration directory")
+	flag.BoolVar(&opts.Debug, "debug", false, "Show debugging output")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Only show changes without applying them")
+	flag.StringVar(&opts.Output, "output", "text", "Output format, either 'text' or 'json'")
+	flag.DurationVar(&opts.MaxCacheAge, "max-cache-age", MaxCacheAge, "Refresh the package cache before installing packages if older than this, 0 to never refresh it")
+	flag.StringVar(&opts.Root, "root", "", "Configure the system under this directory instead of /")
+	flag.StringVar(&opts.PackageManager, "package-manager", "", "Package manager to use instead of detecting it, 'none' to disable packages")
+	flag.StringVar(&opts.FakePackages, "fake-packages", os.Getenv("PETS_FAKE_PACKAGES"), "Use a fake package manager with the given JSON state file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION]... [plan -out FILE | apply [-replan] FILE]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	return confDir, *debug, *dryRun
+
+	if opts.PackageManager != "" && opts.FakePackages != "" {
+		fmt.Fprintln(os.Stderr, "-package-manager cannot be used together with -fake-packages or PETS_FAKE_PACKAGES")
+		os.Exit(2)
+	}
+
+	if flag.NArg() == 0 {
+		return opts
+	}
+
+	opts.Command = flag.Arg(0)
+	subFlags := flag.NewFlagSet(opts.Command, flag.ExitOnError)
+
+	switch opts.Command {
+	case "plan":
+		subFlags.StringVar(&opts.PlanFile, "out", "plan.json", "Save the plan to this file")
+		subFlags.Parse(flag.Args()[1:])
+	case "apply":
+		subFlags.BoolVar(&opts.Replan, "replan", false, "Plan again if the saved plan is stale, instead of failing")
+		subFlags.Parse(flag.Args()[1:])
+		if subFlags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "apply: exactly one plan file must be given")
+			os.Exit(2)
+		}
+		opts.PlanFile = subFlags.Arg(0)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", opts.Command)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	return opts
 }
 
 // GetLogFilter returns a LevelFilter suitable for log.SetOutput().
@@ -38,20 +106,10 @@ func GetLogFilter(debug bool) *logutils.LevelFilter {
 	}
 }
 
-func main() {
-	startTime := time.Now()
-
-	confDir, debug, dryRun := ParseFlags()
-
-	log.SetOutput(GetLogFilter(debug))
-
-	// Print distro family
-	family := WhichPackageManager()
-	if family == APT {
-		log.Println("[DEBUG] Running on a Debian-like system")
-	} else if family == YUM {
-		log.Println("[DEBUG] Running on a RedHat-like system")
-	}
+// ParseAndValidate runs the configuration parser and the global validator on
+// the given directory. The boolean returned is false if the run has to stop
+// because of global validation errors.
+func ParseAndValidate(confDir string) ([]*PetsFile, bool) {
 	// *** Config parser ***
 
 	// Generate a list of PetsFiles from the given config directory.
@@ -69,40 +127,91 @@ func main() {
 	// *** Config validator ***
 	log.Println("[DEBUG] * configuration validation starts *")
 	globalErrors := CheckGlobalConstraints(files)
+	if globalErrors == nil {
+		globalErrors = CheckConfDir(files, confDir)
+	}
 
 	if globalErrors != nil {
 		log.Println(globalErrors)
 		// Global validation errors mean we should stop the whole update.
-		return
+		return nil, false
 	}
 
+	return files, true
+}
+
+// PlanActions validates the individual files and returns the list of
+// actions to perform, together with the files that passed validation. The
+// actions of early files come first. If early files are going to change, they
+// are followed by a package cache refresh marked as EarlyRefresh. The deferred
+// post-update commands of all files go last.
+func PlanActions(files []*PetsFile) ([]*PetsAction, []*PetsFile) {
+	// Look up all packages at once, instead of file by file
+	LoadPackages(AllPackages(files))
+
 	// Check validation errors in individual files. At this stage, the
 	// command in the "pre" validation directive may not be installed yet.
-	// Ignore PathErrors for now. Get a list of valid files.
-	goodPets := CheckLocalConstraints(files, true)
+	// Ignore PathErrors for now. Early files go first: only the valid ones
+	// change repositories. They can only require other early files.
+	early, late := SplitPhases(files)
+	goodEarly := CheckLocalConstraints(early, true)
+
+	refreshCmd := WhichPackageManager().Refresh()
+	refresh := refreshCmd != nil && len(ChangedFiles(goodEarly)) > 0
+
+	if refresh {
+		// Repositories are about to change. Packages of the other files
+		// may come from new repositories, see RunPhases.
+		earlyPkgs := make(map[PetsPackage]bool)
+		for _, pkg := range AllPackages(goodEarly) {
+			earlyPkgs[pkg] = true
+		}
+
+		for _, pkg := range AllPackages(late) {
+			if !earlyPkgs[pkg] {
+				AssumeAvailable([]PetsPackage{pkg})
+			}
+		}
+	}
+
+	// Get a list of valid files.
+	goodPets := dropMissingRequirements(append(goodEarly, validFiles(late, true)...))
 
 	log.Println("[DEBUG] * configuration validation ends *")
 
 	// Generate the list of actions to perform.
-	actions := NewPetsActions(goodPets)
+	goodEarly, goodLate := SplitPhases(goodPets)
+	actions, handlers := newPetsActions(goodEarly)
 
-	// *** Update visualizer ***
-	// Display:
-	// - packages to install
-	// - files created/modified
-	// - content diff (maybe?)
-	// - owner changes
-	// - permissions changes
-	// - which post-update commands will be executed
-	for _, action := range actions {
-		log.Println("[INFO]", action)
-	}
+	lateActions, lateHandlers := newPetsActions(goodLate)
+	handlers = MergeHandlers(handlers, lateHandlers)
 
-	if dryRun {
-		log.Println("[INFO] user requested dry-run mode, not applying any changes")
-		return
+	if refresh {
+		actions = append(actions, &PetsAction{
+			Cause:        PKG_REFRESH,
+			Command:      refreshCmd,
+			EarlyRefresh: true,
+		})
+
+		if len(lateActions) > 0 && lateActions[0].Cause == PKG_REFRESH {
+			// Refreshed already
+			lateActions = lateActions[1:]
+		}
 	}
 
+	actions = append(actions, lateActions...)
+	return append(actions, handlers...), goodPets
+}
+
+// RunActions performs the given actions in order and returns the exit status
+// of the whole pets run.
+func RunActions(actions []*PetsAction) int {
+	return runActions(actions, make(map[*PetsFile]bool))
+}
+
+// runActions is RunActions, marking the files that could not be applied in
+// the given map.
+func runActions(actions []*PetsAction, failed map[*PetsFile]bool) int {
 	// *** Update executor ***
 	// Install missing packages
 	// Create missing directories
@@ -110,19 +219,393 @@ func main() {
 	// Update files
 	// Change permissions/owners
 	// Run post-update commands
+	//
+	// A failure stops all further actions of the same file, and of the files
+	// requiring it. Other files are not affected. The 'onfail' command of
+	// each file that could not be applied is run.
 	exitStatus := 0
+
 	for _, action := range actions {
+		// Deferred post-update commands and service actions run unless all
+		// the files requesting them have failed
+		files := action.Notifiers
+		if len(files) == 0 && action.Trigger != nil {
+			files = []*PetsFile{action.Trigger}
+		}
+
+		for _, pf := range files {
+			if failed[pf] {
+				continue
+			}
+
+			if required := failedRequirement(pf, failed); required != nil {
+				log.Printf("[ERROR] %s: required file %s failed\n", pf.Source, required.Source)
+				failed[pf] = true
+				exitStatus = 1
+				pf.RunOnFail(action.Cause.String(), fmt.Errorf("required file %s failed", required.Source))
+			}
+		}
+
+		if len(files) > 0 && allFailed(files, failed) {
+			log.Printf("[INFO] skipping %s\n", action)
+			continue
+		}
+
+		// Owners may have been created by the actions performed so far,
+		// including those of this very file. This is the last chance for
+		// them to exist.
+		if trigger := action.Trigger; trigger != nil && action.Cause == OWNER {
+			resolve := trigger.ResolveDirOwner
+			if chownsDest(action) {
+				resolve = trigger.ResolveOwner
+			}
+
+			if err := resolve(); err != nil {
+				log.Printf("[ERROR] skipping %s: %s\n", action, err)
+				failed[trigger] = true
+				exitStatus = 1
+				trigger.RunOnFail(action.Cause.String(), err)
+				continue
+			}
+		}
+
 		log.Printf("[INFO] running '%s'\n", action.Command)
 
-		err = action.Perform()
+		err := action.Perform()
 		if err != nil {
 			log.Printf("[ERROR] performing action %s: %s\n", action, err)
+			if action.Trigger == nil {
+				// Not specific to any file, eg: package installation
+				return 1
+			}
+
 			exitStatus = 1
+
+			notifiers := action.Notifiers
+			if len(notifiers) == 0 {
+				notifiers = []*PetsFile{action.Trigger}
+			}
+
+			for _, pf := range notifiers {
+				if !failed[pf] {
+					failed[pf] = true
+					pf.RunOnFail(action.Cause.String(), err)
+				}
+			}
+		}
+	}
+
+	return exitStatus
+}
+
+// failedRequirement returns the first file required by pf that is marked as
+// failed, or nil.
+func failedRequirement(pf *PetsFile, failed map[*PetsFile]bool) *PetsFile {
+	for _, required := range pf.RequiredFiles {
+		if failed[required] {
+			return required
+		}
+	}
+	return nil
+}
+
+// allFailed returns true if all the given files are marked as failed.
+func allFailed(files []*PetsFile, failed map[*PetsFile]bool) bool {
+	for _, pf := range files {
+		if !failed[pf] {
+			return false
+		}
+	}
+	return true
+}
+
+// RunPhases performs the actions returned by PlanActions for the given files.
+// If they include a package cache refresh, the actions after it are planned
+// again once the refresh is done: only then can the packages of new
+// repositories be validated. The actions of the new plan are added to the
+// report, which must have been built out of the given actions. Files in
+// badPets already had their 'onfail' command run. All actions considered are
+// returned, together with the exit status.
+func RunPhases(files []*PetsFile, actions []*PetsAction, badPets []*PetsFile, report *PetsReport) ([]*PetsAction, int) {
+	// Refreshing because of the early files, as opposed to refreshing an
+	// old package cache
+	refresh := -1
+	for i, action := range actions {
+		if action.EarlyRefresh {
+			refresh = i
 			break
 		}
 	}
 
+	if refresh == -1 {
+		return actions, RunActions(actions)
+	}
+
+	early, late := SplitPhases(files)
+
+	// The deferred post-update commands requested by early files still have
+	// to run at the end. Those of the other files are planned again.
+	handlers := []*PetsAction{}
+	for _, action := range actions[refresh+1:] {
+		if action.Cause != POST || len(action.Notifiers) == 0 {
+			continue
+		}
+
+		notifiers := []*PetsFile{}
+		for _, pf := range action.Notifiers {
+			if containsPetsFile(early, pf) {
+				notifiers = append(notifiers, pf)
+			}
+		}
+
+		if len(notifiers) > 0 {
+			handlers = append(handlers, &PetsAction{
+				Cause:     action.Cause,
+				Command:   action.Command,
+				Trigger:   notifiers[0],
+				Notifiers: notifiers,
+			})
+		}
+	}
+
+	// *** Early phase ***
+	failed := make(map[*PetsFile]bool)
+	actions = actions[:refresh+1]
+	report.Actions = report.Actions[:refresh+1]
+
+	exitStatus := runActions(actions, failed)
+	if actions[refresh].Result == nil || actions[refresh].Result.ExitStatus != 0 {
+		// Early actions failed, or the refresh itself did
+		return actions, 1
+	}
+
+	// *** Late phase ***
+	log.Println("[INFO] package cache refreshed, planning the remaining actions")
+	ForgetPackages()
+
+	// Early files that failed are left out, so that the files requiring
+	// them are invalid
+	toPlan := []*PetsFile{}
+	for _, pf := range early {
+		if !failed[pf] {
+			toPlan = append(toPlan, pf)
+		}
+	}
+
+	lateActions, goodPets := PlanActions(append(toPlan, late...))
+	lateActions = MergeHandlers(lateActions, handlers)
+
+	for _, pf := range InvalidFiles(late, goodPets) {
+		if !containsPetsFile(badPets, pf) {
+			pf.RunOnFail("VALIDATION", fmt.Errorf("invalid configuration file %s", pf.Source))
+			if pf.RefusesSymlink() {
+				exitStatus = 1
+			}
+		}
+	}
+
+	for _, action := range lateActions {
+		log.Println("[INFO]", action)
+	}
+
+	report.Actions = append(report.Actions, NewPetsReport(lateActions, false).Actions...)
+
+	if runActions(lateActions, failed) != 0 {
+		exitStatus = 1
+	}
+
+	return append(actions, lateActions...), exitStatus
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == FakePackageCommand {
+		// Not a regular run: install or remove fake packages
+		os.Exit(FakePackageMain(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == AttrCommand {
+		// Not a regular run: set ACLs or extended attributes
+		os.Exit(SetAttrMain(os.Args[2:]))
+	}
+
+	startTime := time.Now()
+
+	opts := ParseFlags()
+
+	logFilter := GetLogFilter(opts.Debug)
+	if opts.Output == "json" {
+		// Keep stdout for the JSON document
+		logFilter.Writer = os.Stderr
+	} else if opts.Output != "text" {
+		fmt.Fprintf(os.Stderr, "invalid output format '%s'\n", opts.Output)
+		os.Exit(1)
+	}
+	log.SetOutput(logFilter)
+
+	var actions []*PetsAction
+
+	// Errors stopping the run before any action is performed. A report is
+	// still written, so that JSON consumers learn about the failure.
+	fail := func() {
+		report := NewPetsReport(actions, opts.DryRun || opts.Command == "plan")
+		report.ExitStatus = 1
+		writeReport(opts, report)
+		os.Exit(1)
+	}
+
+	if opts.PackageManager != "" {
+		pm, err := PackageManagerByName(opts.PackageManager)
+		if err != nil {
+			log.Printf("[ERROR] %v\n", err)
+			fail()
+		}
+		UsePackageManager(pm)
+	} else if opts.FakePackages != "" {
+		fake := &Fake{StateFile: opts.FakePackages}
+		if !fake.Detect() {
+			log.Printf("[ERROR] cannot use fake package state file %s\n", opts.FakePackages)
+			fail()
+		}
+		UsePackageManager(fake)
+	}
+
+	MaxCacheAge = opts.MaxCacheAge
+
+	if opts.Root != "" {
+		root, err := filepath.Abs(opts.Root)
+		if err != nil {
+			log.Printf("[ERROR] invalid root directory %s: %v\n", opts.Root, err)
+			fail()
+		}
+		RootDir = root
+	}
+
+	// Print distro family
+	log.Printf("[DEBUG] Using package manager %s\n", WhichPackageManager().Name())
+
+	// All pets files, and those that did not pass validation if validation
+	// was performed
+	var files, badPets []*PetsFile
+
+	// Saved plans are applied as they are, without planning again after
+	// refreshing the package cache
+	fromPlan := false
+
+	if opts.Command == "apply" {
+		// Apply a plan previously saved with 'pets plan'
+		plan, err := LoadPlan(opts.PlanFile)
+		if err != nil {
+			log.Printf("[ERROR] loading plan: %v\n", err)
+			fail()
+		}
+
+		if plan.Root != RootDir {
+			log.Printf("[ERROR] plan %s was made for root '%s', not '%s'\n", opts.PlanFile, plan.Root, RootDir)
+			fail()
+		}
+
+		var ok bool
+		files, ok = ParseAndValidate(plan.ConfDir)
+		if !ok {
+			fail()
+		}
+
+		staleErr := plan.CheckStale(files)
+		if staleErr == nil {
+			log.Printf("[INFO] plan %s is up to date\n", opts.PlanFile)
+			actions, err = plan.PetsActions(files)
+			if err != nil {
+				log.Printf("[ERROR] loading plan: %v\n", err)
+				fail()
+			}
+			fromPlan = true
+		} else if opts.Replan {
+			log.Printf("[INFO] %v, planning again\n", staleErr)
+			var goodPets []*PetsFile
+			actions, goodPets = PlanActions(files)
+			badPets = InvalidFiles(files, goodPets)
+		} else {
+			log.Printf("[ERROR] %v, refusing to apply it\n", staleErr)
+			fail()
+		}
+	} else {
+		var ok bool
+		files, ok = ParseAndValidate(opts.ConfDir)
+		if !ok {
+			fail()
+		}
+
+		var goodPets []*PetsFile
+		actions, goodPets = PlanActions(files)
+		badPets = InvalidFiles(files, goodPets)
+
+		if opts.Command == "plan" {
+			plan := NewPetsPlan(opts.ConfDir, files, goodPets, actions)
+			if err := plan.Save(opts.PlanFile); err != nil {
+				log.Printf("[ERROR] saving plan: %v\n", err)
+				fail()
+			}
+			log.Printf("[INFO] plan saved to %s\n", opts.PlanFile)
+		}
+	}
+
+	// *** Update visualizer ***
+	// Display:
+	// - packages to install
+	// - files created/modified
+	// - content diff (maybe?)
+	// - owner changes
+	// - permissions changes
+	// - which post-update commands will be executed
+	for _, action := range actions {
+		log.Println("[INFO]", action)
+	}
+
+	report := NewPetsReport(actions, opts.DryRun || opts.Command == "plan")
+
+	if opts.Command == "plan" {
+		writeReport(opts, report)
+		return
+	}
+
+	if opts.DryRun {
+		log.Println("[INFO] user requested dry-run mode, not applying any changes")
+		writeReport(opts, report)
+		return
+	}
+
+	for _, pf := range badPets {
+		pf.RunOnFail("VALIDATION", fmt.Errorf("invalid configuration file %s", pf.Source))
+	}
+
+	var exitStatus int
+	if fromPlan {
+		exitStatus = RunActions(actions)
+	} else {
+		actions, exitStatus = RunPhases(files, actions, badPets, report)
+	}
+
+	for _, pf := range badPets {
+		if pf.RefusesSymlink() {
+			exitStatus = 1
+		}
+	}
+
 	log.Printf("[INFO] pets run took %v\n", time.Since(startTime).Round(time.Millisecond))
 
+	report.AddResults(actions, exitStatus)
+	writeReport(opts, report)
+
 	os.Exit(exitStatus)
 }
+
+// writeReport prints the given report to stdout if JSON output was requested.
+func writeReport(opts *PetsOptions, report *PetsReport) {
+	if opts.Output != "json" {
+		return
+	}
+
+	if err := report.WriteJSON(os.Stdout); err != nil {
+		log.Printf("[ERROR] writing JSON output: %v\n", err)
+	}
+}
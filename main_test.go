@@ -3,16 +3,33 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	// The fake package manager runs the test binary as if it were pets
+	if len(os.Args) > 1 && os.Args[1] == FakePackageCommand {
+		os.Exit(FakePackageMain(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == AttrCommand {
+		// Not a regular run: set ACLs or extended attributes
+		os.Exit(SetAttrMain(os.Args[2:]))
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestParseFlags(t *testing.T) {
-	confDir, debug, dryRun := ParseFlags()
-	if len(confDir) == 0 {
+	opts := ParseFlags()
+	if len(opts.ConfDir) == 0 {
 		t.Errorf("ParseFlags() returned a empty confDir")
 	}
-	assertEquals(t, debug, false)
-	assertEquals(t, dryRun, false)
+	assertEquals(t, opts.Debug, false)
+	assertEquals(t, opts.DryRun, false)
+	assertEquals(t, opts.Output, "text")
 }
 
 func TestGetLogFilter(t *testing.T) {
@@ -22,3 +39,233 @@ func TestGetLogFilter(t *testing.T) {
 	filter = GetLogFilter(false)
 	assertEquals(t, string(filter.MinLevel), "INFO")
 }
+
+func TestRunActionsRequires(t *testing.T) {
+	first := NewPetsFile()
+	second := NewPetsFile()
+	second.RequiredFiles = []*PetsFile{first}
+	third := NewPetsFile()
+
+	actions := []*PetsAction{
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/false"}), Trigger: first},
+		{Cause: MODE, Command: NewCmd([]string{"/bin/true"}), Trigger: first},
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/true"}), Trigger: second},
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/true"}), Trigger: third},
+	}
+
+	assertEquals(t, RunActions(actions), 1)
+
+	if actions[0].Result == nil {
+		t.Errorf("Expecting the first action to be performed")
+	}
+
+	// Same file, and file requiring the failed one
+	if actions[1].Result != nil || actions[2].Result != nil {
+		t.Errorf("Expecting actions depending on a failed one to be skipped")
+	}
+
+	// Unrelated file
+	if actions[3].Result == nil {
+		t.Errorf("Expecting unrelated actions to be performed")
+	}
+}
+
+func TestRunActionsHandlers(t *testing.T) {
+	first := NewPetsFile()
+	second := NewPetsFile()
+
+	handler := &PetsAction{
+		Cause:     POST,
+		Command:   NewCmd([]string{"/bin/true"}),
+		Trigger:   first,
+		Notifiers: []*PetsFile{first, second},
+	}
+
+	actions := []*PetsAction{
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/false"}), Trigger: first},
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/true"}), Trigger: second},
+		handler,
+	}
+
+	// One of the two files failed, the handler runs anyways
+	assertEquals(t, RunActions(actions), 1)
+	if handler.Result == nil {
+		t.Errorf("Expecting the handler to be performed")
+	}
+
+	// Both failed
+	handler.Result = nil
+	actions[1].Command = NewCmd([]string{"/bin/false"})
+	assertEquals(t, RunActions(actions), 1)
+	if handler.Result != nil {
+		t.Errorf("Expecting the handler to be skipped")
+	}
+
+	// The other file requires the failed one
+	handler.Result = nil
+	actions[1].Command = NewCmd([]string{"/bin/true"})
+	actions = actions[:1]
+	second.RequiredFiles = []*PetsFile{first}
+	assertEquals(t, RunActions(append(actions, handler)), 1)
+	if handler.Result != nil {
+		t.Errorf("Expecting the handler to be skipped")
+	}
+}
+
+func TestRunActionsOnFail(t *testing.T) {
+	out := t.TempDir() + "/onfail"
+
+	first := NewPetsFile()
+	first.AddOnFail("/bin/sh -c echo>>" + out)
+	second := NewPetsFile()
+	second.AddOnFail("/bin/sh -c echo>>" + out)
+	second.RequiredFiles = []*PetsFile{first}
+
+	actions := []*PetsAction{
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/false"}), Trigger: first},
+		{Cause: MODE, Command: NewCmd([]string{"/bin/true"}), Trigger: first},
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/true"}), Trigger: second},
+	}
+
+	assertEquals(t, RunActions(actions), 1)
+
+	// Once for each file
+	lines, err := os.ReadFile(out)
+	assertNoError(t, err)
+	assertEquals(t, string(lines), "\n\n")
+}
+
+func TestRunActionsUnknownOwner(t *testing.T) {
+	root := newTestRoot(t)
+	withRootDir(t, root)
+
+	tmpDir := t.TempDir()
+	out := filepath.Join(tmpDir, "created")
+	owned := filepath.Join(tmpDir, "owned")
+
+	pf := NewPetsFile()
+	pf.Dest = owned
+	pf.AddUser("turner")
+	assertEquals(t, pf.User == nil, true)
+
+	// The user is still missing when the owner is changed
+	actions := []*PetsAction{
+		{Cause: CREATE, Command: NewCmd([]string{"/bin/touch", out}), Trigger: pf},
+		{Cause: OWNER, Command: NewCmd([]string{"/bin/touch", owned}), Trigger: pf},
+	}
+	assertEquals(t, RunActions(actions), 1)
+	_, err := os.Stat(out)
+	assertNoError(t, err)
+	_, err = os.Stat(owned)
+	assertEquals(t, os.IsNotExist(err), true)
+
+	// The same file creates it before changing the owner
+	addUser := "echo turner:x:4244:4243::/home/turner:/bin/sh >> " + filepath.Join(root, "etc", "passwd")
+	pf.AddAccount("turner")
+	actions = []*PetsAction{
+		{Cause: USER_CREATE, Command: NewCmd([]string{"/bin/sh", "-c", addUser}), Trigger: pf},
+		{Cause: OWNER, Command: NewCmd([]string{"/bin/touch", owned}), Trigger: pf},
+	}
+	assertEquals(t, RunActions(actions), 0)
+	assertEquals(t, pf.User.Uid, "4244")
+	_, err = os.Stat(owned)
+	assertNoError(t, err)
+}
+
+func TestPlanActionsInvalidEarly(t *testing.T) {
+	stateFile := withFakePackages(t, &FakePackageState{Available: map[string]string{"vim": "2:9.0.1378-2"}})
+	defer ForgetPackages()
+
+	tmpDir := t.TempDir()
+	confDir := filepath.Join(tmpDir, "pets")
+	assertNoError(t, os.Mkdir(confDir, 0755))
+
+	// Would add polpette to the fake repository, but fails validation
+	repo := "# pets: destfile=" + stateFile + ", phase=early, pre=/bin/false\n" + `{"available": {"polpette": "1.0-1", "vim": "2:9.0.1378-2"}}` + "\n"
+	assertNoError(t, os.WriteFile(filepath.Join(confDir, "repo"), []byte(repo), 0644))
+
+	bogus := "# pets: destfile=" + filepath.Join(tmpDir, "polpette") + ", package=polpette\n"
+	assertNoError(t, os.WriteFile(filepath.Join(confDir, "polpette"), []byte(bogus), 0644))
+
+	conf := "# pets: destfile=" + filepath.Join(tmpDir, "y.conf") + ", package=vim\n"
+	assertNoError(t, os.WriteFile(filepath.Join(confDir, "y.conf"), []byte(conf), 0644))
+
+	files, ok := ParseAndValidate(confDir)
+	assertEquals(t, ok, true)
+
+	// No refresh, hence polpette is not assumed to be available
+	actions, goodPets := PlanActions(files)
+	assertEquals(t, len(goodPets), 1)
+	assertEquals(t, actions[0].Command.Args[len(actions[0].Command.Args)-1], "vim")
+	for _, action := range actions {
+		assertEquals(t, action.EarlyRefresh, false)
+	}
+
+	actions, exitStatus := RunPhases(files, actions, InvalidFiles(files, goodPets), NewPetsReport(actions, false))
+	assertEquals(t, exitStatus, 0)
+
+	_, err := os.Stat(filepath.Join(tmpDir, "y.conf"))
+	assertNoError(t, err)
+}
+
+func TestRunPhases(t *testing.T) {
+	stateFile := withFakePackages(t, &FakePackageState{})
+
+	tmpDir := t.TempDir()
+	confDir := filepath.Join(tmpDir, "pets")
+	assertNoError(t, os.Mkdir(confDir, 0755))
+	out := filepath.Join(tmpDir, "onfail")
+	posts := filepath.Join(tmpDir, "posts")
+	post := ", post=/bin/sh -c echo>>" + posts
+
+	// Adding nginx to the fake repository
+	repo := "# pets: destfile=" + stateFile + ", phase=early" + post + "\n" + `{"available": {"nginx": "1.24.0-1"}}` + "\n"
+	assertNoError(t, os.WriteFile(filepath.Join(confDir, "repo"), []byte(repo), 0644))
+
+	conf := "# pets: destfile=" + filepath.Join(tmpDir, "nginx.conf") + ", package=nginx" + post + "\n"
+	assertNoError(t, os.WriteFile(filepath.Join(confDir, "nginx.conf"), []byte(conf), 0644))
+
+	// Not in the repository, but we only know for sure after the refresh
+	bogus := "# pets: destfile=" + filepath.Join(tmpDir, "polpette") + ", package=polpette, onfail=/bin/sh -c echo>>" + out + "\n"
+	assertNoError(t, os.WriteFile(filepath.Join(confDir, "polpette"), []byte(bogus), 0644))
+
+	files, ok := ParseAndValidate(confDir)
+	assertEquals(t, ok, true)
+
+	actions, goodPets := PlanActions(files)
+	assertEquals(t, len(goodPets), 3)
+	assertEquals(t, actions[0].Cause.String(), "FILE_UPDATE")
+	assertEquals(t, actions[1].Cause.String(), "PACKAGE_REFRESH")
+	assertEquals(t, actions[1].EarlyRefresh, true)
+	assertEquals(t, actions[2].Cause.String(), "PACKAGE_INSTALL")
+
+	// The post-update command shared by both phases runs once, at the end
+	last := actions[len(actions)-1]
+	assertEquals(t, last.Cause.String(), "POST_UPDATE")
+	assertEquals(t, len(last.Notifiers), 2)
+
+	report := NewPetsReport(actions, false)
+	actions, exitStatus := RunPhases(files, actions, nil, report)
+	assertEquals(t, exitStatus, 0)
+	assertEquals(t, len(report.Actions), len(actions))
+
+	state, err := LoadFakePackageState(stateFile)
+	assertNoError(t, err)
+	assertEquals(t, state.Installed["nginx"], "1.24.0-1")
+
+	_, err = os.Stat(filepath.Join(tmpDir, "nginx.conf"))
+	assertNoError(t, err)
+
+	// polpette turned out to be invalid
+	_, err = os.Stat(filepath.Join(tmpDir, "polpette"))
+	assertError(t, err)
+
+	lines, err := os.ReadFile(out)
+	assertNoError(t, err)
+	assertEquals(t, string(lines), "\n")
+
+	lines, err = os.ReadFile(posts)
+	assertNoError(t, err)
+	assertEquals(t, string(lines), "\n")
+	assertEquals(t, actions[len(actions)-1].Cause.String(), "POST_UPDATE")
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Machine-readable output. Build a JSON document describing the planned
+// actions and, if they were performed, their results.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// PetsReport is the JSON document emitted with '-output json'. Field names are
+// part of the interface with wrapper scripts: do not rename them.
+type PetsReport struct {
+	DryRun     bool            `json:"dry_run"`
+	Actions    []*ActionReport `json:"actions"`
+	ExitStatus int             `json:"exit_status"`
+}
+
+// ActionReport is the JSON representation of a PetsAction.
+type ActionReport struct {
+	Cause   string        `json:"cause"`
+	Source  string        `json:"source,omitempty"`
+	Dest    string        `json:"dest,omitempty"`
+	Command []string      `json:"command"`
+	Owner   string        `json:"owner,omitempty"`
+	Diff    string        `json:"diff,omitempty"`
+	Result  *ResultReport `json:"result,omitempty"`
+}
+
+// ResultReport is the JSON representation of a PetsActionResult.
+type ResultReport struct {
+	ExitStatus int     `json:"exit_status"`
+	Stdout     string  `json:"stdout"`
+	Stderr     string  `json:"stderr"`
+	Duration   float64 `json:"duration_seconds"`
+}
+
+// NewActionReport returns the JSON-friendly version of the given PetsAction.
+// The diff summary is computed right away, so this has to be called before
+// performing the action.
+func NewActionReport(pa *PetsAction) *ActionReport {
+	report := &ActionReport{
+		Cause:   pa.Cause.String(),
+		Command: pa.Command.Args,
+		Owner:   pa.Owner,
+		Diff:    pa.DiffSummary(),
+	}
+
+	if pa.Trigger != nil {
+		report.Source = pa.Trigger.Source
+		report.Dest = pa.Trigger.Dest
+	}
+
+	return report
+}
+
+// NewPetsReport builds a PetsReport out of the given planned actions.
+func NewPetsReport(actions []*PetsAction, dryRun bool) *PetsReport {
+	report := &PetsReport{
+		DryRun:  dryRun,
+		Actions: []*ActionReport{},
+	}
+
+	for _, action := range actions {
+		report.Actions = append(report.Actions, NewActionReport(action))
+	}
+
+	return report
+}
+
+// AddResults fills the report with the outcome of the given actions, which
+// must be the same ones the report was built from.
+func (pr *PetsReport) AddResults(actions []*PetsAction, exitStatus int) {
+	pr.ExitStatus = exitStatus
+
+	for i, action := range actions {
+		if action.Result == nil {
+			// Action not performed
+			continue
+		}
+
+		pr.Actions[i].Result = &ResultReport{
+			ExitStatus: action.Result.ExitStatus,
+			Stdout:     action.Result.Stdout,
+			Stderr:     action.Result.Stderr,
+			Duration:   action.Result.Duration.Seconds(),
+		}
+	}
+}
+
+// WriteJSON writes the report to w as indented JSON.
+func (pr *PetsReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(pr)
+}
+
+// countLines returns how many times each line occurs in the given file.
+func countLines(fileName string) (map[string]int, error) {
+	lines := make(map[string]int)
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines[scanner.Text()] += 1
+	}
+
+	return lines, scanner.Err()
+}
+
+// DiffSummary returns a short description of the changes a FILE_CREATE or
+// FILE_UPDATE action is going to make, such as "+3 -1 lines". The empty string
+// is returned for all other actions. This is not a real diff: lines are
+// compared regardless of their position, which is good enough to tell a
+// one-liner from a rewrite.
+func (pa *PetsAction) DiffSummary() string {
+	if pa.Trigger == nil || (pa.Cause != CREATE && pa.Cause != UPDATE) {
+		return ""
+	}
+
+	newLines, err := countLines(pa.Trigger.Source)
+	if err != nil {
+		return ""
+	}
+
+	oldLines, err := countLines(pa.Trigger.Dest)
+	if os.IsNotExist(err) {
+		oldLines = map[string]int{}
+	} else if err != nil {
+		return ""
+	}
+
+	added, removed := 0, 0
+
+	for line, count := range newLines {
+		if count > oldLines[line] {
+			added += count - oldLines[line]
+		}
+	}
+
+	for line, count := range oldLines {
+		if count > newLines[line] {
+			removed += count - newLines[line]
+		}
+	}
+
+	return fmt.Sprintf("+%d -%d lines", added, removed)
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestDiffSummary(t *testing.T) {
+	pf, err := NewTestFile("sample_pet/ssh/sshd_config", "ssh", "/tmp/polpette", "root", "root", "0640", "", "")
+	assertNoError(t, err)
+
+	pa := FileToCopy(pf, pf.NeedsCopy())
+	assertEquals(t, pa.DiffSummary(), "+30 -0 lines")
+
+	pf.AddDest("sample_pet/ssh/sshd_config")
+	pa = &PetsAction{Cause: UPDATE, Command: NewCmd([]string{"/bin/true"}), Trigger: pf}
+	assertEquals(t, pa.DiffSummary(), "+0 -0 lines")
+
+	pa.Cause = MODE
+	assertEquals(t, pa.DiffSummary(), "")
+}
+
+func TestPetsReport(t *testing.T) {
+	pa := &PetsAction{
+		Cause:   POST,
+		Command: NewCmd([]string{"/bin/echo", "polpette"}),
+	}
+
+	actions := []*PetsAction{pa}
+
+	report := NewPetsReport(actions, false)
+	assertEquals(t, len(report.Actions), 1)
+	if report.Actions[0].Result != nil {
+		t.Errorf("Expecting nil Result, got %v instead", report.Actions[0].Result)
+	}
+
+	assertNoError(t, pa.Perform())
+	report.AddResults(actions, 0)
+
+	var out bytes.Buffer
+	assertNoError(t, report.WriteJSON(&out))
+
+	var decoded map[string]interface{}
+	assertNoError(t, json.Unmarshal(out.Bytes(), &decoded))
+
+	assertEquals(t, decoded["dry_run"], false)
+
+	action := decoded["actions"].([]interface{})[0].(map[string]interface{})
+	assertEquals(t, action["cause"], "POST_UPDATE")
+
+	result := action["result"].(map[string]interface{})
+	assertEquals(t, result["exit_status"], float64(0))
+	assertEquals(t, result["stdout"], "polpette\n")
+}
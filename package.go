@@ -3,205 +3,472 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
-// A PetsPackage represents a distribution package.
+// A PetsPackage represents a distribution package. It can optionally include
+// a version pattern after an equal sign, eg: nginx=1.24.*
 type PetsPackage string
 
-// PackageManager available on the system. APT on Debian-based distros, YUM on
-// RedHat and derivatives.
-type PackageManager int
-
-const (
-	APT = iota
-	YUM
-	APK
-	YAY
-	PACMAN
-)
+// Name returns the package name, without version.
+func (pp PetsPackage) Name() string {
+	name, _, _ := strings.Cut(string(pp), "=")
+	return name
+}
 
-// WhichPackageManager is available on the system
-func WhichPackageManager() PackageManager {
-	var err error
+// WantedVersion returns the version pattern of the package, or the empty
+// string if any version is fine. Patterns use shell syntax, see path.Match.
+func (pp PetsPackage) WantedVersion() string {
+	_, version, _ := strings.Cut(string(pp), "=")
+	return version
+}
 
-	apt := NewCmd([]string{"apt", "--help"})
-	_, _, err = RunCmd(apt)
-	if err == nil {
-		return APT
+// MatchesVersion returns true if the given version is acceptable.
+func (pp PetsPackage) MatchesVersion(version string) bool {
+	if pp.WantedVersion() == "" {
+		return true
 	}
 
-	yum := NewCmd([]string{"yum", "--help"})
-	_, _, err = RunCmd(yum)
-	if err == nil {
-		return YUM
+	matched, err := path.Match(pp.WantedVersion(), version)
+	if err != nil {
+		log.Printf("[ERROR] invalid version pattern for %s: %s\n", pp.Name(), err)
+		return false
 	}
+	return matched
+}
 
-	apk := NewCmd([]string{"apk", "--version"})
-	_, _, err = RunCmd(apk)
-	if err == nil {
-		return APK
+// versionedArgs returns the package names to pass to the package manager in
+// order to install the given packages. Versions, if any, are appended to the
+// package name after sep.
+func versionedArgs(pkgs []PetsPackage, sep string) []string {
+	args := []string{}
+	for _, pkg := range pkgs {
+		if pkg.WantedVersion() == "" {
+			args = append(args, pkg.Name())
+		} else {
+			args = append(args, pkg.Name()+sep+pkg.WantedVersion())
+		}
 	}
+	return args
+}
 
-	// Yay has to be first because yay wraps pacman
-	yay := NewCmd([]string{"yay", "--version"})
-	if _, _, err = RunCmd(yay); err == nil {
-		return YAY
+// anyVersion returns true if any of the given packages has a wanted version.
+func anyVersion(pkgs []PetsPackage) bool {
+	for _, pkg := range pkgs {
+		if pkg.WantedVersion() != "" {
+			return true
+		}
 	}
+	return false
+}
 
-	pacman := NewCmd([]string{"pacman", "--version"})
-	if _, _, err = RunCmd(pacman); err == nil {
-		return PACMAN
+// pkgNames strips the version from the given packages.
+func pkgNames(pkgs []PetsPackage) []PetsPackage {
+	names := []PetsPackage{}
+	for _, pkg := range pkgs {
+		names = append(names, PetsPackage(pkg.Name()))
 	}
-
-	panic("Unknown Package Manager")
+	return names
 }
 
-func (pp PetsPackage) getPkgInfo() string {
-	var pkgInfo *exec.Cmd
+// A PackageManager knows how to query and modify the packages of a distro
+// family. All methods taking a slice of packages are meant to handle all of
+// them with as few commands as possible.
+type PackageManager interface {
+	// Name of the package manager, eg: "apt"
+	Name() string
+	// Detect returns true if the package manager is available on the system
+	Detect() bool
+	// Distros returns the os-release(5) IDs of the distributions using
+	// this package manager
+	Distros() []string
+	// IsAvailable returns which of the given packages can be installed
+	IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error)
+	// IsInstalled returns which of the given packages are installed
+	IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error)
+	// Version returns the installed version of the given packages. Packages
+	// that are not installed are not included.
+	Version(pkgs []PetsPackage) (map[PetsPackage]string, error)
+	// Install returns the command to install the given packages, at the
+	// wanted version if any. Already installed packages are upgraded or
+	// downgraded as needed.
+	Install(pkgs []PetsPackage) *exec.Cmd
+	// Remove returns the command to remove the given packages
+	Remove(pkgs []PetsPackage) *exec.Cmd
+	// Refresh returns the command to update the list of available
+	// packages, eg: after adding a repository. nil if there is nothing to
+	// refresh.
+	Refresh() *exec.Cmd
+	// RepositoryFiles returns the glob patterns of the files configuring
+	// repositories and their keys
+	RepositoryFiles() []string
+	// CacheFiles returns the glob patterns of the files updated when
+	// refreshing the package cache
+	CacheFiles() []string
+}
 
-	switch WhichPackageManager() {
-	case APT:
-		pkgInfo = NewCmd([]string{"apt-cache", "policy", string(pp)})
-	case YUM:
-		pkgInfo = NewCmd([]string{"yum", "info", string(pp)})
-	case APK:
-		pkgInfo = NewCmd([]string{"apk", "search", "-e", string(pp)})
-	case PACMAN:
-		pkgInfo = NewCmd([]string{"pacman", "-Si", string(pp)})
-	case YAY:
-		pkgInfo = NewCmd([]string{"yay", "-Si", string(pp)})
-	}
+// PackageManagers is the registry of supported package managers, in the order
+// in which they are detected. Add new ones here.
+var PackageManagers = []PackageManager{
+	&Apt{},
+	// dnf has to be before yum because yum is an alias of dnf on modern
+	// RedHat-like systems
+	&Dnf{Command: "dnf5"},
+	&Dnf{Command: "dnf"},
+	&Yum{},
+	&Zypper{},
+	&Apk{},
+	// Yay has to be before pacman because yay wraps pacman
+	&Pacman{Command: "yay"},
+	&Pacman{Command: "pacman"},
+}
 
-	stdout, _, err := RunCmd(pkgInfo)
+// The package manager is detected only once per run.
+var detectedPackageManager PackageManager
 
-	if err != nil {
-		log.Printf("[ERROR] pkgInfoPolicy() command %s failed: %s\n", pkgInfo, err)
-		return ""
+// IsRepositoryFile returns true if the given destination path configures the
+// repositories of the package manager, or their keys.
+func IsRepositoryFile(dest string) bool {
+	for _, pattern := range WhichPackageManager().RepositoryFiles() {
+		if matched, _ := filepath.Match(RootPath(pattern), dest); matched {
+			return true
+		}
 	}
-
-	return stdout
+	return false
 }
 
-// IsValid returns true if the given PetsPackage is available in the distro.
-func (pp PetsPackage) IsValid() bool {
-	stdout := pp.getPkgInfo()
-	family := WhichPackageManager()
+// MaxCacheAge is how old the package cache can be when installing packages.
+// Older caches are refreshed first. Zero means never.
+var MaxCacheAge = 24 * time.Hour
 
-	if family == APT && strings.HasPrefix(stdout, string(pp)) {
-		// Return true if the output of apt-cache policy begins with pp
-		log.Printf("[DEBUG] %s is a valid package name\n", pp)
-		return true
+// PackageCacheStale returns true if the package cache is older than
+// MaxCacheAge, or if it cannot be found at all.
+func PackageCacheStale() bool {
+	if MaxCacheAge <= 0 {
+		return false
 	}
 
-	if family == YUM {
-		for _, line := range strings.Split(stdout, "\n") {
-			line = strings.TrimSpace(line)
-			pkgName := strings.SplitN(line, ": ", 2)
-			if len(pkgName) == 2 {
-				if strings.TrimSpace(pkgName[0]) == "Name" {
-					return pkgName[1] == string(pp)
-				}
+	var newest time.Time
+
+	for _, pattern := range WhichPackageManager().CacheFiles() {
+		matches, _ := filepath.Glob(RootPath(pattern))
+		for _, match := range matches {
+			fileInfo, err := os.Stat(match)
+			if err == nil && fileInfo.ModTime().After(newest) {
+				newest = fileInfo.ModTime()
 			}
 		}
 	}
 
-	if family == APK && strings.HasPrefix(stdout, string(pp)) {
-		// Return true if the output of apk search -e begins with pp
-		log.Printf("[DEBUG] %s is a valid package name\n", pp)
+	if newest.IsZero() {
+		log.Println("[INFO] package cache not found")
 		return true
 	}
 
-	if (family == PACMAN || family == YAY) && !strings.HasPrefix(stdout, "error:") {
-		// Return true if the output of pacman -Si doesnt begins with error
-		log.Printf("[DEBUG] %s is a valid package name\n", pp)
+	if age := time.Since(newest); age > MaxCacheAge {
+		log.Printf("[INFO] package cache is %v old\n", age.Round(time.Minute))
 		return true
 	}
 
-	log.Printf("[ERROR] %s is not an available package\n", pp)
 	return false
 }
 
-// IsInstalled returns true if the given PetsPackage is installed on the
-// system.
-func (pp PetsPackage) IsInstalled() bool {
-	family := WhichPackageManager()
-
-	if family == APT {
-		stdout := pp.getPkgInfo()
-		for _, line := range strings.Split(stdout, "\n") {
-			line = strings.TrimSpace(line)
-			if strings.HasPrefix(line, "Installed: ") {
-				version := strings.SplitN(line, ": ", 2)
-				return version[1] != "(none)"
+// UsePackageManager skips detection and makes pets use the given package
+// manager.
+func UsePackageManager(pm PackageManager) {
+	detectedPackageManager = pm
+	ForgetPackages()
+}
+
+// osReleaseIDs returns the ID of the distribution, followed by the IDs of the
+// distributions it is derived from (ID_LIKE), as found in os-release(5).
+func osReleaseIDs() []string {
+	ids := []string{}
+	like := []string{}
+
+	for _, fileName := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		data, err := os.ReadFile(RootPath(fileName))
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+			if !found {
+				continue
+			}
+
+			value = strings.Trim(value, "\"'")
+
+			switch key {
+			case "ID":
+				ids = append(ids, value)
+			case "ID_LIKE":
+				like = append(like, strings.Fields(value)...)
 			}
 		}
 
-		log.Printf("[ERROR] no 'Installed:' line in apt-cache policy %s\n", pp)
-		return false
+		break
 	}
 
-	if family == YUM {
-		installed := NewCmd([]string{"rpm", "-qa", string(pp)})
-		stdout, _, err := RunCmd(installed)
-		if err != nil {
-			log.Printf("[ERROR] running %s: '%s'", installed, err)
-			return false
+	return append(ids, like...)
+}
+
+// PackageManagerByName returns the package manager with the given name, as
+// returned by PackageManager.Name(). "none" stands for NoPackageManager.
+func PackageManagerByName(name string) (PackageManager, error) {
+	for _, pm := range append(PackageManagers, &NoPackageManager{}) {
+		if pm.Name() == name {
+			return pm, nil
 		}
-		return len(stdout) > 0
 	}
+	return nil, fmt.Errorf("unknown package manager '%s'", name)
+}
 
-	if family == APK {
-		installed := NewCmd([]string{"apk", "info", "-e", string(pp)})
-		stdout, _, err := RunCmd(installed)
-		if err != nil {
-			log.Printf("[ERROR] running %s: '%s'\n", installed, err)
-			return false
+// WhichPackageManager is available on the system. The distribution is
+// identified with os-release(5) first, then all package managers are tried.
+// NoPackageManager is returned if none of them works.
+func WhichPackageManager() PackageManager {
+	if detectedPackageManager != nil {
+		return detectedPackageManager
+	}
+
+	for _, id := range osReleaseIDs() {
+		for _, pm := range PackageManagers {
+			if SliceContains(pm.Distros(), id) && pm.Detect() {
+				detectedPackageManager = pm
+				return pm
+			}
+		}
+	}
+
+	// Unknown distribution, or its package manager is not around
+	for _, pm := range PackageManagers {
+		if pm.Detect() {
+			detectedPackageManager = pm
+			return pm
 		}
+	}
+
+	log.Println("[ERROR] no supported package manager found, files with package directives are invalid")
+	detectedPackageManager = &NoPackageManager{}
+	return detectedPackageManager
+}
 
-		// apk info -e $pkg prints the package name to stdout if the package is
-		// installed, nothing otherwise
-		return strings.TrimSpace(stdout) == string(pp)
+// pkgCmdRunner runs package manager commands. Tests replace it to feed
+// backends with canned command output.
+var pkgCmdRunner = RunCmd
+
+// pkgCmdWorks returns true if the given command can be run successfully. It
+// is used to detect which package manager is available.
+func pkgCmdWorks(args ...string) bool {
+	_, _, err := pkgCmdRunner(NewCmd(args))
+	return err == nil
+}
+
+// pkgQuery runs the given package manager query on all the packages and
+// returns its stdout. Queries on multiple packages exit with non-zero status
+// if any of the packages is missing, hence errors are only returned if the
+// command could not be run at all.
+func pkgQuery(args []string, pkgs []PetsPackage) (string, error) {
+	for _, pkg := range pkgs {
+		args = append(args, string(pkg))
+	}
+
+	cmd := NewCmd(args)
+	stdout, _, err := pkgCmdRunner(cmd)
+
+	if _, ok := err.(*exec.ExitError); ok {
+		return stdout, nil
 	}
 
-	if family == PACMAN || family == YAY {
-		installed := NewCmd([]string{"pacman", "-Q", string(pp)})
-		if family == YAY {
-			installed = NewCmd([]string{"yay", "-Q", string(pp)})
+	return stdout, err
+}
+
+// pkgCommand returns the given command with the packages appended.
+func pkgCommand(args []string, pkgs []PetsPackage) *exec.Cmd {
+	for _, pkg := range pkgs {
+		args = append(args, string(pkg))
+	}
+	return NewCmd(args)
+}
+
+// fieldValues returns the values of all the "Key: value" lines in the output
+// of a package manager with the given key, eg: all "Name : pkg" lines of yum
+// info.
+func fieldValues(stdout, key string) []string {
+	values := []string{}
+
+	for _, line := range strings.Split(stdout, "\n") {
+		field := strings.SplitN(line, ":", 2)
+		if len(field) == 2 && strings.TrimSpace(field[0]) == key {
+			values = append(values, strings.TrimSpace(field[1]))
 		}
-		// pacman and yay will return 0 if the package is installed 1 if not
-		if _, _, err := RunCmd(installed); err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
-				return exitError.ExitCode() == 0
-			}
-			log.Printf("[ERROR] running %s: '%s'", installed, err)
-			return false
+	}
+
+	return values
+}
+
+// pkgsFound returns a map with all the given packages as keys, and true as
+// value for those included in found.
+func pkgsFound(pkgs []PetsPackage, found []string) map[PetsPackage]bool {
+	result := make(map[PetsPackage]bool)
+	for _, pkg := range pkgs {
+		result[pkg] = SliceContains(found, string(pkg))
+	}
+	return result
+}
+
+// installedFromVersions turns the output of PackageManager.Version() into
+// the output of PackageManager.IsInstalled(). Useful for backends where the
+// two queries are the same.
+func installedFromVersions(pkgs []PetsPackage, versions map[PetsPackage]string, err error) (map[PetsPackage]bool, error) {
+	installed := make(map[PetsPackage]bool)
+	for _, pkg := range pkgs {
+		_, installed[pkg] = versions[pkg]
+	}
+	return installed, err
+}
+
+// pkgState is what we know about a given package.
+type pkgState struct {
+	// Available in the distro
+	Valid bool
+	// Installed at the wanted version, if any
+	Installed bool
+	// Installed version, empty if not installed at all
+	Version string
+}
+
+// Package states are looked up once per run and cached here.
+var pkgCache = make(map[PetsPackage]*pkgState)
+
+// queryPackages looks up the given packages and returns their state.
+func queryPackages(pkgs []PetsPackage) (map[PetsPackage]*pkgState, error) {
+	states := make(map[PetsPackage]*pkgState)
+	for _, pkg := range pkgs {
+		states[pkg] = &pkgState{}
+	}
+
+	pm := WhichPackageManager()
+	names := pkgNames(pkgs)
+
+	available, err := pm.IsAvailable(names)
+	if err != nil {
+		return states, err
+	}
+
+	versions, err := pm.Version(names)
+	if err != nil {
+		return states, err
+	}
+
+	for _, pkg := range pkgs {
+		name := PetsPackage(pkg.Name())
+		version, installed := versions[name]
+
+		states[pkg].Valid = available[name]
+		states[pkg].Version = version
+		states[pkg].Installed = installed && pkg.MatchesVersion(version)
+
+		if installed && !states[pkg].Installed {
+			log.Printf("[INFO] %s version %s is installed instead of %s\n", name, version, pkg.WantedVersion())
 		}
+	}
+
+	return states, nil
+}
+
+// LoadPackages fetches the state of all the given packages with as few
+// commands as possible, and caches it for the rest of the run. Packages
+// already in the cache are not looked up again.
+func LoadPackages(pkgs []PetsPackage) {
+	toLoad := []PetsPackage{}
+	seen := make(map[PetsPackage]bool)
+	for _, pkg := range pkgs {
+		if _, ok := pkgCache[pkg]; !ok && !seen[pkg] {
+			toLoad = append(toLoad, pkg)
+			seen[pkg] = true
+		}
+	}
+
+	if len(toLoad) == 0 {
+		return
+	}
+
+	log.Printf("[DEBUG] looking up %d packages\n", len(toLoad))
+
+	states, err := queryPackages(toLoad)
+	if err != nil {
+		log.Printf("[ERROR] looking up packages %v: %s\n", toLoad, err)
+	}
+
+	for pkg, state := range states {
+		pkgCache[pkg] = state
+	}
+}
+
+// AllPackages returns the packages required, or to be removed, by the given
+// files.
+func AllPackages(files []*PetsFile) []PetsPackage {
+	pkgs := []PetsPackage{}
+	for _, pf := range files {
+		pkgs = append(pkgs, pf.Pkgs...)
+		pkgs = append(pkgs, pf.AbsentPkgs...)
+	}
+	return pkgs
+}
+
+// ForgetPackages empties the package cache, for instance after installing
+// new packages.
+func ForgetPackages() {
+	pkgCache = make(map[PetsPackage]*pkgState)
+}
+
+// AssumeAvailable marks the given packages as valid even if the package
+// manager does not know about them (yet). This is the case of packages coming
+// from repositories that are about to be added.
+func AssumeAvailable(pkgs []PetsPackage) {
+	for _, pkg := range pkgs {
+		if state := pkg.state(); state != nil && !state.Valid {
+			log.Printf("[INFO] %s not available yet, assuming it will be after refreshing the package cache\n", pkg)
+			state.Valid = true
+		}
+	}
+}
+
+// state returns the cached state of the package, looking it up if needed.
+func (pp PetsPackage) state() *pkgState {
+	LoadPackages([]PetsPackage{pp})
+	return pkgCache[pp]
+}
+
+// IsValid returns true if the given PetsPackage is available in the distro.
+func (pp PetsPackage) IsValid() bool {
+	if pp.state().Valid {
+		log.Printf("[DEBUG] %s is a valid package name\n", pp)
 		return true
 	}
+
+	log.Printf("[ERROR] %s is not an available package\n", pp)
 	return false
 }
 
-// InstallCommand returns the command needed to install packages on this
-// system.
-func InstallCommand() *exec.Cmd {
-	switch WhichPackageManager() {
-	case APT:
-		cmd := NewCmd([]string{"apt-get", "-y", "install"})
-		cmd.Env = os.Environ()
-		cmd.Env = append(cmd.Env, "DEBIAN_FRONTEND=noninteractive")
-		return cmd
-	case YUM:
-		return NewCmd([]string{"yum", "-y", "install"})
-	case APK:
-		return NewCmd([]string{"apk", "add"})
-	case PACMAN:
-		return NewCmd([]string{"pacman", "-S", "--noconfirm"})
-	case YAY:
-		return NewCmd([]string{"yay", "-S", "--noconfirm"})
-	}
-	return nil
+// IsInstalled returns true if the given PetsPackage is installed on the
+// system, at the wanted version if any.
+func (pp PetsPackage) IsInstalled() bool {
+	return pp.state().Installed
+}
+
+// InstalledVersion returns the version of the package installed on the
+// system, or the empty string if the package is not installed.
+func (pp PetsPackage) InstalledVersion() string {
+	return pp.state().Version
 }
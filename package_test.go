@@ -28,3 +28,73 @@ func TestIsNotInstalled(t *testing.T) {
 	pkg = PetsPackage("this is getting ridiculous")
 	assertEquals(t, pkg.IsInstalled(), false)
 }
+
+func TestPkgCache(t *testing.T) {
+	defer ForgetPackages()
+
+	// Not a real package, but the cache says otherwise
+	pkgCache[PetsPackage("polpette")] = &pkgState{Valid: true, Installed: true}
+	assertEquals(t, PetsPackage("polpette").IsValid(), true)
+	assertEquals(t, PetsPackage("polpette").IsInstalled(), true)
+
+	ForgetPackages()
+	assertEquals(t, PetsPackage("polpette").IsValid(), false)
+	assertEquals(t, PetsPackage("polpette").IsInstalled(), false)
+}
+
+func TestLoadPackages(t *testing.T) {
+	defer ForgetPackages()
+
+	LoadPackages([]PetsPackage{"coreutils", "abiword", "this is getting ridiculous", "coreutils"})
+	assertEquals(t, len(pkgCache), 3)
+
+	assertEquals(t, pkgCache["coreutils"].Valid, true)
+	assertEquals(t, pkgCache["coreutils"].Installed, true)
+	assertEquals(t, pkgCache["abiword"].Installed, false)
+	assertEquals(t, pkgCache["this is getting ridiculous"].Valid, false)
+}
+
+func TestPkgVersion(t *testing.T) {
+	pkg := PetsPackage("nginx")
+	assertEquals(t, pkg.Name(), "nginx")
+	assertEquals(t, pkg.WantedVersion(), "")
+	assertEquals(t, pkg.MatchesVersion("1.22.1-9"), true)
+
+	pkg = PetsPackage("nginx=1.24.*")
+	assertEquals(t, pkg.Name(), "nginx")
+	assertEquals(t, pkg.WantedVersion(), "1.24.*")
+	assertEquals(t, pkg.MatchesVersion("1.24.0-2"), true)
+	assertEquals(t, pkg.MatchesVersion("1.22.1-9"), false)
+}
+
+func TestPkgInstalledVersion(t *testing.T) {
+	defer ForgetPackages()
+
+	LoadPackages([]PetsPackage{"coreutils", "coreutils=0.1", "abiword"})
+
+	assertEquals(t, PetsPackage("coreutils").IsInstalled(), true)
+	assertEquals(t, PetsPackage("coreutils").IsValid(), true)
+
+	// Installed, but not at the wanted version
+	assertEquals(t, PetsPackage("coreutils=0.1").IsInstalled(), false)
+	assertEquals(t, PetsPackage("coreutils=0.1").IsValid(), true)
+	assertEquals(t, PetsPackage("coreutils=0.1").InstalledVersion(), PetsPackage("coreutils").InstalledVersion())
+
+	assertEquals(t, PetsPackage("abiword").InstalledVersion(), "")
+}
+
+func TestVersionedInstall(t *testing.T) {
+	pkgs := []PetsPackage{"nginx=1.24.*", "vim"}
+
+	assertEquals(t, (&Apt{}).Install(pkgs).Args[3], "--allow-downgrades")
+	assertEquals(t, (&Apt{}).Install(pkgs).Args[4], "nginx=1.24.*")
+	assertEquals(t, (&Yum{}).Install(pkgs).Args[3], "nginx-1.24.*")
+	assertEquals(t, (&Dnf{Command: "dnf"}).Install(pkgs).Args[3], "nginx-1.24.*")
+	assertEquals(t, (&Apk{}).Install(pkgs).Args[2], "nginx~1.24")
+	assertEquals(t, (&Apk{}).Install([]PetsPackage{"nginx=1.24.0-r1"}).Args[2], "nginx=1.24.0-r1")
+	assertEquals(t, (&Zypper{}).Install(pkgs).Args[4], "nginx=1.24.*")
+	assertEquals(t, (&Pacman{Command: "pacman"}).Install(pkgs).Args[3], "nginx")
+
+	// Versions do not matter when removing packages
+	assertEquals(t, (&Apt{}).Remove(pkgs).Args[3], "nginx")
+}
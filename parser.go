@@ -18,6 +18,10 @@ import (
 // Because it is important to know when enough is enough.
 const MAXLINES int = 10
 
+// DirMarker is the name of the file holding the modelines of a directory that
+// has to be symlinked as a whole, eg: nginx/snippets/.pets
+const DirMarker = ".pets"
+
 // ReadModelines looks into the given file and searches for pets modelines. A
 // modeline is any string which includes the 'pets:' substring. All modelines
 // found are returned as-is in a slice.
@@ -89,25 +93,108 @@ func ParseModeline(line string, pf *PetsFile) error {
 			pf.AddDest(argument)
 		case "symlink":
 			pf.AddLink(argument)
-		case "owner":
-			err = pf.AddUser(argument)
-			if err != nil {
-				log.Printf("[ERROR] unknown 'owner' %s, skipping directive\n", argument)
+		case "absent":
+			pf.AddAbsent(argument)
+		case "force":
+			if pf.AddForce(argument) != nil {
+				return badKeyword
 			}
-		case "group":
-			err = pf.AddGroup(argument)
-			if err != nil {
-				log.Printf("[ERROR] unknown 'group' %s, skipping directive\n", argument)
+		case "relative":
+			if pf.AddRelative(argument) != nil {
+				return badKeyword
+			}
+		case "state":
+			if pf.AddState(argument) != nil {
+				return badKeyword
 			}
+		case "owner":
+			pf.AddUser(argument)
+		case "group":
+			pf.AddGroup(argument)
 		case "mode":
 			pf.AddMode(argument)
+		case "acl":
+			if err := pf.AddACL(argument); err != nil {
+				log.Printf("[ERROR] %v\n", err)
+				return badKeyword
+			}
+		case "xattr":
+			if err := pf.AddXattr(argument); err != nil {
+				log.Printf("[ERROR] %v\n", err)
+				return badKeyword
+			}
+		case "dirowner":
+			pf.AddDirUser(argument)
+		case "dirgroup":
+			pf.AddDirGroup(argument)
+		case "dirmode":
+			if pf.AddDirMode(argument) != nil {
+				return badKeyword
+			}
+		case "direnforce":
+			if pf.AddDirEnforce(argument) != nil {
+				return badKeyword
+			}
 		case "package":
 			// haha gotcha this one has no setter
 			pf.Pkgs = append(pf.Pkgs, PetsPackage(argument))
+		case "absent_package":
+			pf.AbsentPkgs = append(pf.AbsentPkgs, PetsPackage(argument))
+		case "version":
+			if pf.AddVersion(argument) != nil {
+				return badKeyword
+			}
 		case "pre":
 			pf.AddPre(argument)
 		case "post":
 			pf.AddPost(argument)
+		case "post_immediate":
+			if pf.AddPostImmediate(argument) != nil {
+				return badKeyword
+			}
+		case "onfail":
+			pf.AddOnFail(argument)
+		case "phase":
+			if pf.AddPhase(argument) != nil {
+				return badKeyword
+			}
+		case "after":
+			pf.AddAfter(argument)
+		case "requires":
+			pf.AddRequires(argument)
+		case "user":
+			pf.AddAccount(argument)
+		case "usergroup":
+			pf.AddAccountGroup(argument)
+		case "uid":
+			if pf.AddUid(argument) != nil {
+				return badKeyword
+			}
+		case "gid":
+			if pf.AddGid(argument) != nil {
+				return badKeyword
+			}
+		case "home":
+			if pf.AddHome(argument) != nil {
+				return badKeyword
+			}
+		case "shell":
+			if pf.AddShell(argument) != nil {
+				return badKeyword
+			}
+		case "groups":
+			if pf.AddGroups(argument) != nil {
+				return badKeyword
+			}
+		case "system":
+			if pf.AddSystem(argument) != nil {
+				return badKeyword
+			}
+		case "service":
+			if err := pf.AddService(argument); err != nil {
+				log.Printf("[ERROR] %v\n", err)
+				return badKeyword
+			}
 		default:
 			return badKeyword
 		}
@@ -133,12 +220,19 @@ func ParseFiles(directory string) ([]*PetsFile, error) {
 			return err
 		}
 
+		modelinesPath := path
+
 		if info.IsDir() {
-			// Skip directories
-			return nil
+			// Directories are skipped, unless they have a DirMarker file
+			// asking for the whole directory to be symlinked. In that case
+			// their contents are not pets files on their own.
+			modelinesPath = filepath.Join(path, DirMarker)
+			if _, err := os.Stat(modelinesPath); path == directory || err != nil {
+				return nil
+			}
 		}
 
-		modelines, err := ReadModelines(path)
+		pf, err := ParseFile(modelinesPath, path)
 		if err != nil {
 			// Returning the error we stop parsing all other files too. Debatable
 			// whether we want to do that here or not. ReadModelines should not
@@ -148,48 +242,72 @@ func ParseFiles(directory string) ([]*PetsFile, error) {
 			return err
 		}
 
-		if len(modelines) == 0 {
-			// Not a Pets file. We don't take it personal though
-			return nil
+		if pf != nil && info.IsDir() && !pf.Link {
+			log.Println(fmt.Errorf("[ERROR] directories can only be symlinked, but '%s' has no 'symlink' directive", modelinesPath))
+			pf = nil
 		}
 
-		log.Printf("[DEBUG] %d pets modelines found in %s\n", len(modelines), path)
-
-		// Instantiate a PetsFile representation. The only thing we know so far
-		// is the source path. Every long journey begins with a single step!
-		pf := NewPetsFile()
+		if pf != nil {
+			log.Printf("[DEBUG] '%s' pets syntax OK\n", modelinesPath)
+			petsFiles = append(petsFiles, pf)
+		}
 
-		// Get absolute path to the source. Technically we would be fine with a
-		// relative path too, but it's good to remove abiguity. Plus absolute
-		// paths make things easier in case we have to create a symlink.
-		abs, err := filepath.Abs(path)
-		if err != nil {
-			return err
+		if info.IsDir() {
+			return filepath.SkipDir
 		}
+		return nil
+	})
 
-		pf.Source = abs
+	return petsFiles, err
+}
 
-		for _, line := range modelines {
-			err := ParseModeline(line, pf)
-			if err != nil {
-				// Possibly a syntax error, skip the whole file but do not return
-				// an error! Otherwise all other files will be skipped too.
-				log.Println(err) // XXX: log to stderr
-				return nil
-			}
-		}
+// ParseFile reads the modelines in the given file and returns the PetsFile
+// representation of source, usually the same file. nil is returned if the
+// file has no modelines or they are invalid, since there is nothing to do.
+func ParseFile(path, source string) (*PetsFile, error) {
+	modelines, err := ReadModelines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(modelines) == 0 {
+		// Not a Pets file. We don't take it personal though
+		return nil, nil
+	}
 
-		if pf.Dest == "" {
-			// 'destfile' or 'symlink' are mandatory arguments. If we did not
-			// find any, consider it an error.
-			log.Println(fmt.Errorf("[ERROR] Neither 'destfile' nor 'symlink' directives found in '%s'", path))
-			return nil
+	log.Printf("[DEBUG] %d pets modelines found in %s\n", len(modelines), path)
+
+	// Instantiate a PetsFile representation. The only thing we know so far
+	// is the source path. Every long journey begins with a single step!
+	pf := NewPetsFile()
+
+	// Get absolute path to the source. Technically we would be fine with a
+	// relative path too, but it's good to remove abiguity. Plus absolute
+	// paths make things easier in case we have to create a symlink.
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+
+	pf.Source = abs
+
+	for _, line := range modelines {
+		err := ParseModeline(line, pf)
+		if err != nil {
+			// Possibly a syntax error, skip the whole file but do not return
+			// an error! Otherwise all other files will be skipped too.
+			log.Println(err) // XXX: log to stderr
+			return nil, nil
 		}
+	}
 
-		log.Printf("[DEBUG] '%s' pets syntax OK\n", path)
-		petsFiles = append(petsFiles, pf)
-		return nil
-	})
+	if pf.Dest == "" && len(pf.AbsentPkgs) == 0 && pf.Account == nil && pf.AccountGroup == nil && len(pf.Services) == 0 {
+		// 'destfile' or 'symlink' are mandatory arguments, unless the
+		// file only lists packages to remove, accounts or services to
+		// manage. If we did not find any, consider it an error.
+		log.Println(fmt.Errorf("[ERROR] Neither 'destfile' nor 'symlink' directives found in '%s'", path))
+		return nil, nil
+	}
 
-	return petsFiles, err
+	return pf, nil
 }
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -69,3 +71,143 @@ func TestParseModelineOKPackage(t *testing.T) {
 	assertEquals(t, pf.Dest, "")
 	assertEquals(t, string(pf.Pkgs[0]), "vim")
 }
+
+func TestParseModelineOKDependencies(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: after=/etc/apt/sources.list.d/nginx.list, requires=ssh/sshd_config, after=vimrc", &pf)
+	assertNoError(t, err)
+
+	assertEquals(t, len(pf.After), 2)
+	assertEquals(t, pf.After[0], "/etc/apt/sources.list.d/nginx.list")
+	assertEquals(t, pf.After[1], "vimrc")
+	assertEquals(t, len(pf.Requires), 1)
+	assertEquals(t, pf.Requires[0], "ssh/sshd_config")
+}
+
+func TestParseModelinePostImmediate(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: post=/bin/systemctl restart nginx, post_immediate=true", &pf)
+	assertNoError(t, err)
+	assertEquals(t, pf.PostImmediate, true)
+
+	err = ParseModeline("# pets: post_immediate=maybe", &pf)
+	assertError(t, err)
+}
+
+func TestParseModelineOKVersion(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: package=nginx=1.24.*, package=vim, version=2:9.0.*", &pf)
+	assertNoError(t, err)
+
+	assertEquals(t, len(pf.Pkgs), 2)
+	assertEquals(t, pf.Pkgs[0].Name(), "nginx")
+	assertEquals(t, pf.Pkgs[0].WantedVersion(), "1.24.*")
+	assertEquals(t, pf.Pkgs[1].Name(), "vim")
+	assertEquals(t, pf.Pkgs[1].WantedVersion(), "2:9.0.*")
+
+	// No package to apply the version to
+	var other PetsFile
+	err = ParseModeline("# pets: version=1.0", &other)
+	assertError(t, err)
+}
+
+func TestParseModelineOKAbsentPackage(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: absent_package=telnet, absent_package=rpcbind", &pf)
+	assertNoError(t, err)
+
+	assertEquals(t, len(pf.AbsentPkgs), 2)
+	assertEquals(t, string(pf.AbsentPkgs[1]), "rpcbind")
+}
+
+func TestParseModelinePhase(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: destfile=/etc/apt/keyrings/nginx.asc, phase=early", &pf)
+	assertNoError(t, err)
+	assertEquals(t, pf.Early, true)
+
+	err = ParseModeline("# pets: phase=whenever", &pf)
+	assertError(t, err)
+}
+
+func TestParseModelineAccounts(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: user=sparrow, uid=4242, home=/srv/sparrow, shell=/bin/sh, groups=adm sudo, usergroup=pirates, gid=4243, system=true", &pf)
+	assertNoError(t, err)
+	assertEquals(t, pf.Account.Name, "sparrow")
+	assertEquals(t, pf.Account.Uid, "4242")
+	assertEquals(t, pf.Account.Home, "/srv/sparrow")
+	assertEquals(t, pf.Account.Shell, "/bin/sh")
+	assertEquals(t, len(pf.Account.Groups), 2)
+	assertEquals(t, pf.Account.System, true)
+	assertEquals(t, pf.AccountGroup.Name, "pirates")
+	assertEquals(t, pf.AccountGroup.Gid, "4243")
+	assertEquals(t, pf.AccountGroup.System, true)
+
+	// Ids must be numeric
+	err = ParseModeline("# pets: uid=sparrow", &pf)
+	assertError(t, err)
+
+	// Options need a user or group first
+	var other PetsFile
+	err = ParseModeline("# pets: uid=4242", &other)
+	assertError(t, err)
+
+	err = ParseModeline("# pets: gid=4242", &other)
+	assertError(t, err)
+
+	err = ParseModeline("# pets: shell=/bin/sh", &other)
+	assertError(t, err)
+}
+
+func TestParseModelineAbsent(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: absent=/etc/nginx/sites-enabled/default", &pf)
+	assertNoError(t, err)
+	assertEquals(t, pf.Dest, "/etc/nginx/sites-enabled/default")
+	assertEquals(t, pf.Absent, true)
+
+	pf = PetsFile{}
+	err = ParseModeline("# pets: symlink=/etc/nginx/sites-enabled/default, state=absent", &pf)
+	assertNoError(t, err)
+	assertEquals(t, pf.Absent, true)
+
+	err = ParseModeline("# pets: state=gone", &pf)
+	assertError(t, err)
+}
+
+func TestParseModelineDirectories(t *testing.T) {
+	var pf PetsFile
+	err := ParseModeline("# pets: destfile=/home/sparrow/.ssh/config, dirowner=root, dirgroup=root, dirmode=0700, direnforce=true", &pf)
+	assertNoError(t, err)
+	assertEquals(t, pf.DirUser.Uid, "0")
+	assertEquals(t, pf.DirGroup.Gid, "0")
+	assertEquals(t, pf.DirMode, "0700")
+	assertEquals(t, pf.DirEnforce, true)
+
+	err = ParseModeline("# pets: dir_enforce=true", &pf)
+	assertError(t, err)
+}
+
+func TestParseFilesDirectory(t *testing.T) {
+	confDir := t.TempDir()
+
+	// Linked as a whole. The modelines of its files are ignored.
+	snippets := filepath.Join(confDir, "snippets")
+	assertNoError(t, os.Mkdir(snippets, 0755))
+	assertNoError(t, os.WriteFile(filepath.Join(snippets, DirMarker), []byte("# pets: symlink=/etc/nginx/snippets, relative=true\n"), 0644))
+	assertNoError(t, os.WriteFile(filepath.Join(snippets, "ssl.conf"), []byte("# pets: destfile=/etc/ssl.conf\n"), 0644))
+
+	// Directories cannot be copied
+	sites := filepath.Join(confDir, "sites")
+	assertNoError(t, os.Mkdir(sites, 0755))
+	assertNoError(t, os.WriteFile(filepath.Join(sites, DirMarker), []byte("# pets: destfile=/etc/nginx/sites\n"), 0644))
+
+	files, err := ParseFiles(confDir)
+	assertNoError(t, err)
+	assertEquals(t, len(files), 1)
+	assertEquals(t, files[0].Source, snippets)
+	assertEquals(t, files[0].Dest, "/etc/nginx/snippets")
+	assertEquals(t, files[0].Link, true)
+	assertEquals(t, files[0].Relative, true)
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// APK backend, for Alpine Linux.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Apk is the PackageManager of Alpine Linux.
+type Apk struct{}
+
+func (apk *Apk) Name() string {
+	return "apk"
+}
+
+func (apk *Apk) Detect() bool {
+	return pkgCmdWorks("apk", "--version")
+}
+
+func (apk *Apk) Distros() []string {
+	return []string{"alpine"}
+}
+
+// apkName splits the name-version strings printed by apk, eg:
+// vim-9.0.1568-r0 -> vim, 9.0.1568-r0
+func apkName(line string) (string, string) {
+	fields := strings.Split(strings.TrimSpace(line), "-")
+	if len(fields) < 3 {
+		return "", ""
+	}
+	return strings.Join(fields[:len(fields)-2], "-"), strings.Join(fields[len(fields)-2:], "-")
+}
+
+// IsAvailable parses the output of apk search -e, which prints one
+// name-version line per available package.
+func (apk *Apk) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	stdout, err := pkgQuery(withRoot([]string{"apk", "search", "-e"}, "--root", RootDir), pkgs)
+
+	found := []string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		name, _ := apkName(line)
+		found = append(found, name)
+	}
+
+	return pkgsFound(pkgs, found), err
+}
+
+func (apk *Apk) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	versions, err := apk.Version(pkgs)
+	return installedFromVersions(pkgs, versions, err)
+}
+
+// Version parses the output of apk list --installed, eg:
+// vim-9.0.1568-r0 x86_64 {vim} (Vim) [installed]
+func (apk *Apk) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	stdout, err := pkgQuery(withRoot([]string{"apk", "list", "--installed"}, "--root", RootDir), pkgs)
+
+	versions := make(map[PetsPackage]string)
+	for _, line := range strings.Split(stdout, "\n") {
+		name, version := apkName(strings.SplitN(line, " ", 2)[0])
+		if name != "" {
+			versions[PetsPackage(name)] = version
+		}
+	}
+
+	return versions, err
+}
+
+// Install renders versions as pkg=version. Patterns like 1.24.* become
+// pkg~1.24, which is apk syntax for "any 1.24 version".
+func (apk *Apk) Install(pkgs []PetsPackage) *exec.Cmd {
+	args := withRoot([]string{"apk", "add"}, "--root", RootDir)
+
+	for _, pkg := range pkgs {
+		version := pkg.WantedVersion()
+		if strings.HasSuffix(version, ".*") && !strings.ContainsAny(strings.TrimSuffix(version, ".*"), "*?[") {
+			args = append(args, pkg.Name()+"~"+strings.TrimSuffix(version, ".*"))
+		} else {
+			args = append(args, versionedArgs([]PetsPackage{pkg}, "=")...)
+		}
+	}
+
+	return NewCmd(args)
+}
+
+func (apk *Apk) Remove(pkgs []PetsPackage) *exec.Cmd {
+	return pkgCommand(withRoot([]string{"apk", "del"}, "--root", RootDir), pkgNames(pkgs))
+}
+
+func (apk *Apk) Refresh() *exec.Cmd {
+	return NewCmd(withRoot([]string{"apk", "update"}, "--root", RootDir))
+}
+
+func (apk *Apk) RepositoryFiles() []string {
+	return []string{
+		"/etc/apk/repositories",
+		"/etc/apk/keys/*",
+	}
+}
+
+func (apk *Apk) CacheFiles() []string {
+	return []string{"/var/cache/apk/APKINDEX.*.tar.gz"}
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"testing"
+)
+
+func TestApkName(t *testing.T) {
+	name, version := apkName("vim-9.0.1568-r0")
+	assertEquals(t, name, "vim")
+	assertEquals(t, version, "9.0.1568-r0")
+
+	name, _ = apkName("py3-setuptools-68.0.0-r0\n")
+	assertEquals(t, name, "py3-setuptools")
+
+	name, _ = apkName("garbage")
+	assertEquals(t, name, "")
+}
+
+func TestApkIsAvailable(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"apk search -e vim py3-setuptools polpette": "vim-9.0.1568-r0\npy3-setuptools-68.0.0-r0\n",
+	})
+
+	available, err := (&Apk{}).IsAvailable([]PetsPackage{"vim", "py3-setuptools", "polpette"})
+	assertNoError(t, err)
+	assertEquals(t, available["vim"], true)
+	assertEquals(t, available["py3-setuptools"], true)
+	assertEquals(t, available["polpette"], false)
+}
+
+func TestApkVersion(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"apk list --installed vim py3-setuptools": "vim-9.0.1568-r0 x86_64 {vim} (Vim) [installed]\n",
+	})
+
+	pkgs := []PetsPackage{"vim", "py3-setuptools"}
+
+	versions, err := (&Apk{}).Version(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, len(versions), 1)
+	assertEquals(t, versions["vim"], "9.0.1568-r0")
+
+	installed, err := (&Apk{}).IsInstalled(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, installed["vim"], true)
+	assertEquals(t, installed["py3-setuptools"], false)
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// APT backend, for Debian and derivatives.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Apt is the PackageManager of Debian-like systems.
+type Apt struct{}
+
+func (apt *Apt) Name() string {
+	return "apt"
+}
+
+func (apt *Apt) Detect() bool {
+	return pkgCmdWorks("apt", "--help")
+}
+
+func (apt *Apt) Distros() []string {
+	return []string{"debian", "ubuntu"}
+}
+
+// IsAvailable parses the output of apt-cache policy pkg1 pkg2 ... Available
+// packages have a section starting with the package name, missing ones are not
+// mentioned at all.
+//
+// vim:
+//
+//	Installed: (none)
+//	Candidate: 2:9.0.1378-2
+func (apt *Apt) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	stdout, err := pkgQuery(withRoot([]string{"apt-cache", "policy"}, "-o", "Dir="+RootDir), pkgs)
+
+	found := []string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		if len(line) > 0 && line[0] != ' ' && strings.HasSuffix(line, ":") {
+			found = append(found, strings.TrimSuffix(line, ":"))
+		}
+	}
+
+	return pkgsFound(pkgs, found), err
+}
+
+func (apt *Apt) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	versions, err := apt.Version(pkgs)
+	return installedFromVersions(pkgs, versions, err)
+}
+
+// Version parses the output of dpkg-query. Packages which are known to dpkg
+// but not installed, for example because they have been removed but their
+// configuration files are still around, have a status other than "ii".
+func (apt *Apt) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	stdout, err := pkgQuery(withRoot([]string{"dpkg-query", "-W", "-f", "${Package}\t${db:Status-Abbrev}\t${Version}\n"}, "--admindir="+RootPath("/var/lib/dpkg")), pkgs)
+
+	versions := make(map[PetsPackage]string)
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 3 && strings.TrimSpace(fields[1]) == "ii" {
+			versions[PetsPackage(fields[0])] = fields[2]
+		}
+	}
+
+	return versions, err
+}
+
+// getArgs returns the apt-get command line to run the given operation. With an
+// alternate root, both apt and dpkg are told to use it.
+func (apt *Apt) getArgs(operation string) []string {
+	return withRoot([]string{"apt-get", "-y", operation}, "-o", "Dir="+RootDir, "-o", "DPkg::Options::=--root="+RootDir)
+}
+
+// Install renders versions as pkg=version. Downgrades are allowed, as the
+// only reason to install an older version is that we have been asked to.
+func (apt *Apt) Install(pkgs []PetsPackage) *exec.Cmd {
+	args := apt.getArgs("install")
+	if anyVersion(pkgs) {
+		args = append(args, "--allow-downgrades")
+	}
+
+	cmd := NewCmd(append(args, versionedArgs(pkgs, "=")...))
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "DEBIAN_FRONTEND=noninteractive")
+	return cmd
+}
+
+func (apt *Apt) Remove(pkgs []PetsPackage) *exec.Cmd {
+	cmd := pkgCommand(apt.getArgs("remove"), pkgNames(pkgs))
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "DEBIAN_FRONTEND=noninteractive")
+	return cmd
+}
+
+func (apt *Apt) Refresh() *exec.Cmd {
+	return NewCmd(apt.getArgs("update"))
+}
+
+func (apt *Apt) RepositoryFiles() []string {
+	return []string{
+		"/etc/apt/sources.list",
+		"/etc/apt/sources.list.d/*",
+		"/etc/apt/preferences",
+		"/etc/apt/preferences.d/*",
+		"/etc/apt/auth.conf.d/*",
+		"/etc/apt/trusted.gpg.d/*",
+		"/etc/apt/keyrings/*",
+		"/usr/share/keyrings/*",
+	}
+}
+
+// CacheFiles follows the convention of update-notifier: the stamp file is
+// touched after successful updates, when APT is configured to do so.
+func (apt *Apt) CacheFiles() []string {
+	return []string{
+		"/var/lib/apt/periodic/update-success-stamp",
+		"/var/lib/apt/lists",
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"testing"
+)
+
+func TestAptDetect(t *testing.T) {
+	withPkgOutput(t, map[string]string{"apt --help": "apt 2.6.1 (amd64)\n"})
+	assertEquals(t, (&Apt{}).Detect(), true)
+
+	withPkgOutput(t, map[string]string{})
+	assertEquals(t, (&Apt{}).Detect(), false)
+}
+
+func TestAptIsAvailable(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"apt-cache policy coreutils abiword polpette": `coreutils:
+  Installed: 9.1-1
+  Candidate: 9.1-1
+  Version table:
+ *** 9.1-1 500
+        500 http://deb.debian.org/debian bookworm/main amd64 Packages
+        100 /var/lib/dpkg/status
+abiword:
+  Installed: (none)
+  Candidate: 3.0.5~dfsg-3.2
+  Version table:
+     3.0.5~dfsg-3.2 500
+        500 http://deb.debian.org/debian bookworm/main amd64 Packages
+`,
+	})
+
+	available, err := (&Apt{}).IsAvailable([]PetsPackage{"coreutils", "abiword", "polpette"})
+	assertNoError(t, err)
+	assertEquals(t, len(available), 3)
+	assertEquals(t, available["coreutils"], true)
+	assertEquals(t, available["abiword"], true)
+	assertEquals(t, available["polpette"], false)
+}
+
+func TestAptVersion(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"dpkg-query -W -f ${Package}\t${db:Status-Abbrev}\t${Version}\n coreutils abiword vim": "coreutils\tii \t9.1-1\nvim\trc \t2:9.0.1378-2\n",
+	})
+
+	pkgs := []PetsPackage{"coreutils", "abiword", "vim"}
+
+	versions, err := (&Apt{}).Version(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, len(versions), 1)
+	assertEquals(t, versions["coreutils"], "9.1-1")
+
+	installed, err := (&Apt{}).IsInstalled(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, installed["coreutils"], true)
+	assertEquals(t, installed["abiword"], false)
+	assertEquals(t, installed["vim"], false)
+}
+
+func TestAptCommands(t *testing.T) {
+	cmd := (&Apt{}).Install([]PetsPackage{"vim", "sudo"})
+	assertEquals(t, cmd.String(), NewCmd([]string{"apt-get", "-y", "install", "vim", "sudo"}).String())
+	assertEquals(t, cmd.Env[len(cmd.Env)-1], "DEBIAN_FRONTEND=noninteractive")
+
+	cmd = (&Apt{}).Remove([]PetsPackage{"nano"})
+	assertEquals(t, cmd.String(), NewCmd([]string{"apt-get", "-y", "remove", "nano"}).String())
+}
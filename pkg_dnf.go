@@ -0,0 +1,70 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// DNF backend, for Fedora and modern RedHat-like systems. Works with both dnf
+// and dnf5.
+
+package main
+
+import (
+	"os/exec"
+)
+
+// Dnf is the PackageManager of Fedora and RHEL 8+. Command is either "dnf" or
+// "dnf5".
+type Dnf struct {
+	Command string
+}
+
+func (dnf *Dnf) Name() string {
+	return dnf.Command
+}
+
+func (dnf *Dnf) Detect() bool {
+	return pkgCmdWorks(dnf.Command, "--version")
+}
+
+func (dnf *Dnf) Distros() []string {
+	return []string{"fedora", "rhel", "centos"}
+}
+
+// IsAvailable looks for "Name : pkg" lines in the output of dnf info. Both
+// installed and available packages are listed.
+func (dnf *Dnf) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	stdout, err := pkgQuery(withRoot([]string{dnf.Command, "-q", "info"}, "--installroot="+RootDir), pkgs)
+	return pkgsFound(pkgs, fieldValues(stdout, "Name")), err
+}
+
+func (dnf *Dnf) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	versions, err := dnf.Version(pkgs)
+	return installedFromVersions(pkgs, versions, err)
+}
+
+func (dnf *Dnf) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	return rpmVersion(pkgs)
+}
+
+// Install renders versions as pkg-version, dnf takes care of downgrading
+// packages if needed.
+func (dnf *Dnf) Install(pkgs []PetsPackage) *exec.Cmd {
+	return NewCmd(append(withRoot([]string{dnf.Command, "-y", "install"}, "--installroot="+RootDir), versionedArgs(pkgs, "-")...))
+}
+
+func (dnf *Dnf) Remove(pkgs []PetsPackage) *exec.Cmd {
+	return pkgCommand(withRoot([]string{dnf.Command, "-y", "remove"}, "--installroot="+RootDir), pkgNames(pkgs))
+}
+
+func (dnf *Dnf) Refresh() *exec.Cmd {
+	return NewCmd(withRoot([]string{dnf.Command, "-y", "makecache"}, "--installroot="+RootDir))
+}
+
+func (dnf *Dnf) RepositoryFiles() []string {
+	return rpmRepositoryFiles
+}
+
+// CacheFiles covers both dnf and dnf5.
+func (dnf *Dnf) CacheFiles() []string {
+	return []string{
+		"/var/cache/dnf/*.solv",
+		"/var/cache/libdnf5/*/solv/*.solv",
+	}
+}
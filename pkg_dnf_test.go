@@ -0,0 +1,61 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDnfDetect(t *testing.T) {
+	withPkgOutput(t, map[string]string{"dnf5 --version": "dnf5 version 5.1.15\n"})
+	assertEquals(t, (&Dnf{Command: "dnf5"}).Detect(), true)
+	assertEquals(t, (&Dnf{Command: "dnf"}).Detect(), false)
+}
+
+func TestDnfIsAvailable(t *testing.T) {
+	// dnf5 output
+	withPkgOutput(t, map[string]string{
+		"dnf -q info vim-enhanced nginx polpette": `Installed packages
+Name            : vim-enhanced
+Epoch           : 2
+Version         : 9.1.031
+Release         : 1.fc40
+Architecture    : x86_64
+
+Available packages
+Name            : nginx
+Epoch           : 2
+Version         : 1.26.1
+Release         : 1.fc40
+Architecture    : x86_64
+`,
+	})
+
+	available, err := (&Dnf{Command: "dnf"}).IsAvailable([]PetsPackage{"vim-enhanced", "nginx", "polpette"})
+	assertNoError(t, err)
+	assertEquals(t, available["vim-enhanced"], true)
+	assertEquals(t, available["nginx"], true)
+	assertEquals(t, available["polpette"], false)
+}
+
+func TestDnfVersion(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"rpm -q --qf %{NAME}\\t%{VERSION}-%{RELEASE}\\n vim-enhanced nginx": "vim-enhanced\t9.1.031-1.fc40\npackage nginx is not installed\n",
+	})
+
+	installed, err := (&Dnf{Command: "dnf"}).IsInstalled([]PetsPackage{"vim-enhanced", "nginx"})
+	assertNoError(t, err)
+	assertEquals(t, installed["vim-enhanced"], true)
+	assertEquals(t, installed["nginx"], false)
+}
+
+func TestDnfCommands(t *testing.T) {
+	cmd := (&Dnf{Command: "dnf5"}).Install([]PetsPackage{"nginx"})
+	assertEquals(t, cmd.Args[0], "dnf5")
+	assertEquals(t, cmd.Args[1], "-y")
+	assertEquals(t, cmd.Args[2], "install")
+
+	cmd = (&Dnf{Command: "dnf"}).Remove([]PetsPackage{"telnet"})
+	assertEquals(t, cmd.Args[2], "remove")
+	assertEquals(t, cmd.Args[3], "telnet")
+}
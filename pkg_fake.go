@@ -0,0 +1,243 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Fake backend, for tests and demos. Packages are not real: their state is
+// kept in a JSON file such as the following.
+//
+//	{
+//	  "available": {"vim": "2:9.0.1378-2", "sudo": "1.9.13p3-1"},
+//	  "installed": {"coreutils": "9.1-1"}
+//	}
+//
+// Lines starting with '#' are ignored, so that the file itself can be managed
+// with pets to simulate adding repositories. Installing and removing packages
+// updates the file, keeping those lines at the top. This is done by running pets itself with the hidden
+// "fake-package" command, so that fake actions are regular commands like all
+// others.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// FakePackageCommand is the hidden pets command run by the fake backend to
+// install and remove packages.
+const FakePackageCommand = "fake-package"
+
+// FakePackageState is the content of the fake backend state file. Both maps
+// go from package name to version.
+type FakePackageState struct {
+	Available map[string]string `json:"available"`
+	Installed map[string]string `json:"installed"`
+	// Lines starting with '#', such as pets modelines
+	Comments []string `json:"-"`
+}
+
+// LoadFakePackageState reads the given state file.
+func LoadFakePackageState(fileName string) (*FakePackageState, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip pets modelines and other comments
+	lines, comments := []string{}, []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#") {
+			comments = append(comments, line)
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	state := &FakePackageState{Comments: comments}
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), state); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	if state.Available == nil {
+		state.Available = make(map[string]string)
+	}
+
+	if state.Installed == nil {
+		state.Installed = make(map[string]string)
+	}
+
+	return state, nil
+}
+
+// Save writes the state back to the given file, comments first.
+func (state *FakePackageState) Save(fileName string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	content := ""
+	for _, comment := range state.Comments {
+		content += comment + "\n"
+	}
+
+	return os.WriteFile(fileName, append([]byte(content), append(data, '\n')...), 0644)
+}
+
+// Fake is a PackageManager backed by a JSON file.
+type Fake struct {
+	StateFile string
+}
+
+func (fake *Fake) Name() string {
+	return "fake"
+}
+
+func (fake *Fake) Detect() bool {
+	_, err := LoadFakePackageState(fake.StateFile)
+	return err == nil
+}
+
+// Distros returns nothing, the fake backend is never detected automatically.
+func (fake *Fake) Distros() []string {
+	return nil
+}
+
+// IsAvailable returns true for packages that are either available or
+// installed, like real package managers do.
+func (fake *Fake) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	state, err := LoadFakePackageState(fake.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	available := make(map[PetsPackage]bool)
+	for _, pkg := range pkgs {
+		_, inRepo := state.Available[string(pkg)]
+		_, installed := state.Installed[string(pkg)]
+		available[pkg] = inRepo || installed
+	}
+
+	return available, nil
+}
+
+func (fake *Fake) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	versions, err := fake.Version(pkgs)
+	return installedFromVersions(pkgs, versions, err)
+}
+
+func (fake *Fake) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	state, err := LoadFakePackageState(fake.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[PetsPackage]string)
+	for _, pkg := range pkgs {
+		if version, ok := state.Installed[string(pkg)]; ok {
+			versions[pkg] = version
+		}
+	}
+
+	return versions, nil
+}
+
+// fakeCommand returns the pets command modifying the state file.
+func (fake *Fake) fakeCommand(verb string, pkgs []string) *exec.Cmd {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	return NewCmd(append([]string{self, FakePackageCommand, fake.StateFile, verb}, pkgs...))
+}
+
+// Install renders versions as pkg=version.
+func (fake *Fake) Install(pkgs []PetsPackage) *exec.Cmd {
+	return fake.fakeCommand("install", versionedArgs(pkgs, "="))
+}
+
+func (fake *Fake) Remove(pkgs []PetsPackage) *exec.Cmd {
+	return fake.fakeCommand("remove", versionedArgs(pkgNames(pkgs), "="))
+}
+
+// Refresh only updates the modification time of the state file.
+func (fake *Fake) Refresh() *exec.Cmd {
+	return fake.fakeCommand("refresh", nil)
+}
+
+// RepositoryFiles returns nothing, fake packages have no repositories.
+func (fake *Fake) RepositoryFiles() []string {
+	return nil
+}
+
+// CacheFiles returns the state file, which is touched by Refresh.
+func (fake *Fake) CacheFiles() []string {
+	return []string{fake.StateFile}
+}
+
+// FakePackageMain implements the hidden fake-package command. The arguments
+// are the state file, either "install", "remove" or "refresh", and the
+// packages. The return value is the exit status.
+func FakePackageMain(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s STATE_FILE install|remove|refresh PACKAGE...\n", FakePackageCommand)
+		return 2
+	}
+
+	stateFile, verb, pkgs := args[0], args[1], args[2:]
+
+	state, err := LoadFakePackageState(stateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if verb == "refresh" {
+		now := time.Now()
+		if err := os.Chtimes(stateFile, now, now); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Reading package lists... Done")
+		return 0
+	}
+
+	for _, arg := range pkgs {
+		pkg := PetsPackage(arg)
+		name := pkg.Name()
+
+		switch verb {
+		case "install":
+			version, ok := state.Available[name]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "E: Unable to locate package %s\n", name)
+				return 1
+			}
+
+			// Exact versions are installed as requested, patterns get
+			// whatever is available
+			if wanted := pkg.WantedVersion(); wanted != "" && !strings.ContainsAny(wanted, "*?[") {
+				version = wanted
+			}
+
+			state.Installed[name] = version
+			fmt.Printf("Setting up %s (%s) ...\n", name, version)
+		case "remove":
+			delete(state.Installed, name)
+			fmt.Printf("Removing %s ...\n", name)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown action '%s'\n", verb)
+			return 2
+		}
+	}
+
+	if err := state.Save(stateFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
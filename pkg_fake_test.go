@@ -0,0 +1,141 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newFakeState() *FakePackageState {
+	return &FakePackageState{
+		Available: map[string]string{"vim": "2:9.0.1378-2", "sudo": "1.9.13p3-1"},
+		Installed: map[string]string{"nano": "7.2-1"},
+	}
+}
+
+func TestFakeQueries(t *testing.T) {
+	withFakePackages(t, newFakeState())
+	fake := WhichPackageManager()
+	assertEquals(t, fake.Name(), "fake")
+	assertEquals(t, fake.Detect(), true)
+
+	pkgs := []PetsPackage{"vim", "nano", "polpette"}
+
+	available, err := fake.IsAvailable(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, available["vim"], true)
+	assertEquals(t, available["nano"], true)
+	assertEquals(t, available["polpette"], false)
+
+	versions, err := fake.Version(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, len(versions), 1)
+	assertEquals(t, versions["nano"], "7.2-1")
+
+	assertEquals(t, (&Fake{StateFile: "very-unlikely-to-find-this.json"}).Detect(), false)
+}
+
+func TestFakePackageMain(t *testing.T) {
+	stateFile := withFakePackages(t, newFakeState())
+
+	assertEquals(t, FakePackageMain([]string{stateFile, "install", "vim", "sudo=1.9.13p2-1"}), 0)
+	assertEquals(t, FakePackageMain([]string{stateFile, "remove", "nano"}), 0)
+
+	state, err := LoadFakePackageState(stateFile)
+	assertNoError(t, err)
+	assertEquals(t, len(state.Installed), 2)
+	assertEquals(t, state.Installed["vim"], "2:9.0.1378-2")
+	assertEquals(t, state.Installed["sudo"], "1.9.13p2-1")
+
+	// Pets modelines survive installs
+	state.Comments = []string{"# pets: destfile=/var/lib/fake/packages.json"}
+	assertNoError(t, state.Save(stateFile))
+	assertEquals(t, FakePackageMain([]string{stateFile, "remove", "vim"}), 0)
+
+	state, err = LoadFakePackageState(stateFile)
+	assertNoError(t, err)
+	assertEquals(t, len(state.Installed), 1)
+	assertEquals(t, len(state.Comments), 1)
+	assertEquals(t, state.Comments[0], "# pets: destfile=/var/lib/fake/packages.json")
+
+	// Not available
+	assertEquals(t, FakePackageMain([]string{stateFile, "install", "polpette"}), 1)
+	// Wrong usage
+	assertEquals(t, FakePackageMain([]string{stateFile, "frobnicate", "vim"}), 2)
+	assertEquals(t, FakePackageMain([]string{stateFile}), 2)
+}
+
+func TestFakePipeline(t *testing.T) {
+	stateFile := withFakePackages(t, newFakeState())
+
+	tmpDir := t.TempDir()
+	confDir := filepath.Join(tmpDir, "pets")
+	dest := filepath.Join(tmpDir, "vimrc")
+	assertNoError(t, os.Mkdir(confDir, 0755))
+
+	source := filepath.Join(confDir, "vimrc")
+	assertNoError(t, os.WriteFile(source, []byte("# pets: destfile="+dest+"\n# pets: package=vim\n# pets: absent_package=nano\nsyntax on\n"), 0644))
+
+	files, ok := ParseAndValidate(confDir)
+	assertEquals(t, ok, true)
+
+	actions, goodPets := PlanActions(files)
+	assertEquals(t, len(goodPets), 1)
+	assertEquals(t, len(actions), 3)
+	assertEquals(t, actions[0].Cause.String(), "PACKAGE_INSTALL")
+	assertEquals(t, actions[1].Cause.String(), "PACKAGE_REMOVE")
+	assertEquals(t, actions[2].Cause.String(), "FILE_CREATE")
+
+	assertEquals(t, RunActions(actions), 0)
+
+	state, err := LoadFakePackageState(stateFile)
+	assertNoError(t, err)
+	assertEquals(t, state.Installed["vim"], "2:9.0.1378-2")
+	assertEquals(t, len(state.Installed), 1)
+
+	_, err = os.Stat(dest)
+	assertNoError(t, err)
+
+	// Nothing left to do
+	ForgetPackages()
+	actions, _ = PlanActions(files)
+	assertEquals(t, len(actions), 0)
+}
+
+func TestFakeRefresh(t *testing.T) {
+	stateFile := withFakePackages(t, newFakeState())
+
+	old := time.Now().Add(-48 * time.Hour)
+	assertNoError(t, os.Chtimes(stateFile, old, old))
+	assertEquals(t, PackageCacheStale(), true)
+
+	savedAge := MaxCacheAge
+	t.Cleanup(func() { MaxCacheAge = savedAge })
+
+	// Never refresh
+	MaxCacheAge = 0
+	assertEquals(t, PackageCacheStale(), false)
+
+	MaxCacheAge = 72 * time.Hour
+	assertEquals(t, PackageCacheStale(), false)
+
+	MaxCacheAge = time.Hour
+	pf := NewPetsFile()
+	pf.Source = "/dev/null"
+	pf.Pkgs = []PetsPackage{"vim"}
+
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, actions[0].Cause.String(), "PACKAGE_REFRESH")
+	assertEquals(t, actions[1].Cause.String(), "PACKAGE_INSTALL")
+
+	assertEquals(t, RunActions(actions[:1]), 0)
+	assertEquals(t, PackageCacheStale(), false)
+
+	actions = NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 1)
+	assertEquals(t, actions[0].Cause.String(), "PACKAGE_INSTALL")
+}
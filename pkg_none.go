@@ -0,0 +1,62 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Placeholder backend for systems without a supported package manager, such
+// as NixOS, Gentoo or distroless containers. Files without package directives
+// work as usual, the others are invalid.
+
+package main
+
+import (
+	"os/exec"
+)
+
+// NoPackageManager is the PackageManager used when none is available.
+type NoPackageManager struct{}
+
+func (none *NoPackageManager) Name() string {
+	return "none"
+}
+
+func (none *NoPackageManager) Detect() bool {
+	return true
+}
+
+func (none *NoPackageManager) Distros() []string {
+	return nil
+}
+
+// IsAvailable returns false for all packages.
+func (none *NoPackageManager) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	return make(map[PetsPackage]bool), nil
+}
+
+func (none *NoPackageManager) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	return make(map[PetsPackage]bool), nil
+}
+
+func (none *NoPackageManager) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	return make(map[PetsPackage]string), nil
+}
+
+// Install returns nil, there is no way to install packages.
+func (none *NoPackageManager) Install(pkgs []PetsPackage) *exec.Cmd {
+	return nil
+}
+
+// Remove returns nil, there is no way to remove packages.
+func (none *NoPackageManager) Remove(pkgs []PetsPackage) *exec.Cmd {
+	return nil
+}
+
+// Refresh returns nil, there is no package cache.
+func (none *NoPackageManager) Refresh() *exec.Cmd {
+	return nil
+}
+
+func (none *NoPackageManager) RepositoryFiles() []string {
+	return nil
+}
+
+func (none *NoPackageManager) CacheFiles() []string {
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withOSRelease makes pets detect the package manager again, on a root
+// directory with the given os-release file.
+func withOSRelease(t *testing.T, osRelease string) {
+	root := t.TempDir()
+	assertNoError(t, os.Mkdir(filepath.Join(root, "etc"), 0755))
+	assertNoError(t, os.WriteFile(filepath.Join(root, "etc", "os-release"), []byte(osRelease), 0644))
+
+	withRootDir(t, root)
+	withPackageManager(t, nil)
+}
+
+func TestOSReleaseIDs(t *testing.T) {
+	withOSRelease(t, "NAME=\"Rocky Linux\"\nID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"\n")
+	ids := osReleaseIDs()
+	assertEquals(t, len(ids), 4)
+	assertEquals(t, ids[0], "rocky")
+	assertEquals(t, ids[1], "rhel")
+}
+
+func TestWhichPackageManagerOSRelease(t *testing.T) {
+	withOSRelease(t, "ID=alpine\n")
+	// Both respond, but this is Alpine
+	withPkgOutput(t, map[string]string{
+		"apt --help":    "",
+		"apk --version": "apk-tools 2.14.0",
+	})
+
+	assertEquals(t, WhichPackageManager().Name(), "apk")
+}
+
+func TestWhichPackageManagerFallback(t *testing.T) {
+	withOSRelease(t, "ID=linuxmint\nID_LIKE=\"ubuntu debian\"\n")
+	withPkgOutput(t, map[string]string{"yum --help": ""})
+
+	// apt is not there after all
+	assertEquals(t, WhichPackageManager().Name(), "yum")
+}
+
+func TestWhichPackageManagerNone(t *testing.T) {
+	withOSRelease(t, "ID=nixos\n")
+	withPkgOutput(t, map[string]string{})
+
+	assertEquals(t, WhichPackageManager().Name(), "none")
+
+	// Files with package directives are invalid, the others are fine
+	pf := NewPetsFile()
+	pf.Source = "/dev/null"
+	pf.AddDest("/tmp/foo")
+	pf.Pkgs = []PetsPackage{"vim"}
+	assertEquals(t, pf.IsValid(false), false)
+
+	pf.Pkgs = []PetsPackage{}
+	assertEquals(t, pf.IsValid(false), true)
+
+	pf.AbsentPkgs = []PetsPackage{"telnet"}
+	assertEquals(t, pf.IsValid(false), false)
+
+	// No package actions
+	pf.AbsentPkgs = []PetsPackage{}
+	installPkgs, _ := PkgsToInstall([]*PetsFile{pf})
+	assertEquals(t, installPkgs, false)
+}
+
+func TestPackageManagerByName(t *testing.T) {
+	pm, err := PackageManagerByName("dnf5")
+	assertNoError(t, err)
+	assertEquals(t, pm.Name(), "dnf5")
+
+	pm, err = PackageManagerByName("none")
+	assertNoError(t, err)
+	assertEquals(t, pm.Name(), "none")
+
+	_, err = PackageManagerByName("portage")
+	assertError(t, err)
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Pacman backend, for Arch Linux. Also used for yay, which wraps pacman and
+// accepts the same options.
+
+package main
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// Pacman is the PackageManager of Arch Linux. Command is either "pacman" or
+// "yay".
+type Pacman struct {
+	Command string
+}
+
+func (pacman *Pacman) Name() string {
+	return pacman.Command
+}
+
+func (pacman *Pacman) Detect() bool {
+	return pkgCmdWorks(pacman.Command, "--version")
+}
+
+func (pacman *Pacman) Distros() []string {
+	return []string{"arch"}
+}
+
+// IsAvailable looks for "Name : pkg" lines in the output of pacman -Si.
+func (pacman *Pacman) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	stdout, err := pkgQuery(withRoot([]string{pacman.Command, "-Si"}, "--root", RootDir), pkgs)
+	return pkgsFound(pkgs, fieldValues(stdout, "Name")), err
+}
+
+func (pacman *Pacman) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	versions, err := pacman.Version(pkgs)
+	return installedFromVersions(pkgs, versions, err)
+}
+
+// Version parses the output of pacman -Q, which lists installed packages as
+// "name version".
+func (pacman *Pacman) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	stdout, err := pkgQuery(withRoot([]string{pacman.Command, "-Q"}, "--root", RootDir), pkgs)
+
+	versions := make(map[PetsPackage]string)
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			versions[PetsPackage(fields[0])] = fields[1]
+		}
+	}
+
+	return versions, err
+}
+
+// Install ignores versions: pacman can only install the version available in
+// the sync database. PetsFile.IsValid refuses pinned packages.
+func (pacman *Pacman) Install(pkgs []PetsPackage) *exec.Cmd {
+	if anyVersion(pkgs) {
+		log.Printf("[ERROR] %s cannot install specific package versions, ignoring them\n", pacman.Command)
+	}
+
+	return pkgCommand(withRoot([]string{pacman.Command, "-S", "--noconfirm"}, "--root", RootDir), pkgNames(pkgs))
+}
+
+func (pacman *Pacman) Remove(pkgs []PetsPackage) *exec.Cmd {
+	return pkgCommand(withRoot([]string{pacman.Command, "-R", "--noconfirm"}, "--root", RootDir), pkgNames(pkgs))
+}
+
+func (pacman *Pacman) Refresh() *exec.Cmd {
+	return NewCmd(withRoot([]string{pacman.Command, "-Sy", "--noconfirm"}, "--root", RootDir))
+}
+
+func (pacman *Pacman) RepositoryFiles() []string {
+	return []string{
+		"/etc/pacman.conf",
+		"/etc/pacman.d/*",
+	}
+}
+
+func (pacman *Pacman) CacheFiles() []string {
+	return []string{"/var/lib/pacman/sync/*.db"}
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPacmanIsAvailable(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"yay -Si vim polpette": `Repository      : extra
+Name            : vim
+Version         : 9.0.2153-1
+Description     : Vi Improved, a highly configurable, improved version of the vi text editor
+`,
+	})
+
+	available, err := (&Pacman{Command: "yay"}).IsAvailable([]PetsPackage{"vim", "polpette"})
+	assertNoError(t, err)
+	assertEquals(t, available["vim"], true)
+	assertEquals(t, available["polpette"], false)
+}
+
+func TestPacmanVersion(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"pacman -Q vim polpette": "vim 9.0.2153-1\n",
+	})
+
+	pacman := &Pacman{Command: "pacman"}
+	pkgs := []PetsPackage{"vim", "polpette"}
+
+	versions, err := pacman.Version(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, len(versions), 1)
+	assertEquals(t, versions["vim"], "9.0.2153-1")
+
+	installed, err := pacman.IsInstalled(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, installed["vim"], true)
+	assertEquals(t, installed["polpette"], false)
+
+	assertEquals(t, pacman.Install(pkgs).Args[0], "pacman")
+}
+
+func TestPacmanPinnedVersion(t *testing.T) {
+	withPackageManager(t, &Pacman{Command: "pacman"})
+	withPkgOutput(t, map[string]string{
+		"pacman -Si vim": "Name            : vim\n",
+		"pacman -Q vim":  "vim 9.0.2153-1\n",
+	})
+	defer ForgetPackages()
+
+	pf := NewPetsFile()
+	pf.Source = "/etc/pets/vimrc"
+	pf.Pkgs = []PetsPackage{"vim"}
+	assertEquals(t, pf.IsValid(true), true)
+
+	// Versions cannot be pinned
+	pf.Pkgs = []PetsPackage{"vim=9.0.2153-1"}
+	assertEquals(t, pf.IsValid(true), false)
+}
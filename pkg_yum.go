@@ -0,0 +1,207 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// YUM backend, for RedHat and derivatives.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// Yum is the PackageManager of RedHat-like systems.
+type Yum struct{}
+
+func (yum *Yum) Name() string {
+	return "yum"
+}
+
+func (yum *Yum) Detect() bool {
+	return pkgCmdWorks("yum", "--help")
+}
+
+func (yum *Yum) Distros() []string {
+	return []string{"rhel", "centos", "fedora"}
+}
+
+// IsAvailable looks for "Name : pkg" lines in the output of yum info.
+func (yum *Yum) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	stdout, err := pkgQuery(withRoot([]string{"yum", "info"}, "--installroot="+RootDir), pkgs)
+	return pkgsFound(pkgs, fieldValues(stdout, "Name")), err
+}
+
+func (yum *Yum) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	versions, err := yum.Version(pkgs)
+	return installedFromVersions(pkgs, versions, err)
+}
+
+func (yum *Yum) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	return rpmVersion(pkgs)
+}
+
+// rpmVersion parses the output of rpm -q. Missing packages are reported as
+// "package foo is not installed". Used by all rpm-based backends.
+func rpmVersion(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	stdout, err := pkgQuery(withRoot([]string{"rpm", "-q", "--qf", "%{NAME}\\t%{VERSION}-%{RELEASE}\\n"}, "--root", RootDir), pkgs)
+
+	versions := make(map[PetsPackage]string)
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 2 {
+			versions[PetsPackage(fields[0])] = fields[1]
+		}
+	}
+
+	return versions, err
+}
+
+// Install renders versions as pkg-version. yum install never downgrades:
+// packages installed at a newer version than the wanted one are passed to yum
+// downgrade instead, in the same command.
+func (yum *Yum) Install(pkgs []PetsPackage) *exec.Cmd {
+	install, downgrade := []PetsPackage{}, []PetsPackage{}
+	for _, pkg := range pkgs {
+		if rpmNewer(pkg) {
+			downgrade = append(downgrade, pkg)
+		} else {
+			install = append(install, pkg)
+		}
+	}
+
+	installArgs := append(withRoot([]string{"yum", "-y", "install"}, "--installroot="+RootDir), versionedArgs(install, "-")...)
+	downgradeArgs := append(withRoot([]string{"yum", "-y", "downgrade"}, "--installroot="+RootDir), versionedArgs(downgrade, "-")...)
+
+	switch {
+	case len(downgrade) == 0:
+		return NewCmd(installArgs)
+	case len(install) == 0:
+		return NewCmd(downgradeArgs)
+	default:
+		return NewCmd([]string{"/bin/sh", "-c", shellJoin(installArgs) + " && " + shellJoin(downgradeArgs)})
+	}
+}
+
+// shellJoin returns the given arguments as a sh(1) command line.
+func shellJoin(args []string) string {
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
+// rpmNewer returns true if the given package is installed at a newer version
+// than the wanted one. Version patterns are compared up to their first
+// wildcard.
+func rpmNewer(pkg PetsPackage) bool {
+	wanted := pkg.WantedVersion()
+	if wanted == "" || pkg.InstalledVersion() == "" {
+		return false
+	}
+
+	if i := strings.IndexAny(wanted, "*?["); i != -1 {
+		wanted = wanted[:i]
+	}
+
+	return !pkg.MatchesVersion(pkg.InstalledVersion()) && rpmVerCmp(pkg.InstalledVersion(), wanted) > 0
+}
+
+// rpmVerCmp compares two versions like rpmvercmp(3) does. The result is
+// negative if a is older than b, positive if it is newer, 0 if they are the
+// same.
+func rpmVerCmp(a, b string) int {
+	separator := func(r rune) bool {
+		return r != '~' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	for a != "" || b != "" {
+		a = strings.TrimLeftFunc(a, separator)
+		b = strings.TrimLeftFunc(b, separator)
+
+		// Tilde sorts before anything, even the end of the version
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		// Compare segments of digits or letters, whichever a starts with
+		isSegment := unicode.IsLetter
+		if unicode.IsDigit(rune(a[0])) {
+			isSegment = unicode.IsDigit
+		}
+
+		end := func(s string) int {
+			if i := strings.IndexFunc(s, func(r rune) bool { return !isSegment(r) }); i != -1 {
+				return i
+			}
+			return len(s)
+		}
+
+		segA, segB := a[:end(a)], b[:end(b)]
+		a, b = a[len(segA):], b[len(segB):]
+
+		if segB == "" {
+			// Different kinds of segments: numbers are newer
+			if unicode.IsDigit(rune(segA[0])) {
+				return 1
+			}
+			return -1
+		}
+
+		if unicode.IsDigit(rune(segA[0])) {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				return len(segA) - len(segB)
+			}
+		}
+
+		if cmp := strings.Compare(segA, segB); cmp != 0 {
+			return cmp
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (yum *Yum) Remove(pkgs []PetsPackage) *exec.Cmd {
+	return pkgCommand(withRoot([]string{"yum", "-y", "remove"}, "--installroot="+RootDir), pkgNames(pkgs))
+}
+
+func (yum *Yum) Refresh() *exec.Cmd {
+	return NewCmd(withRoot([]string{"yum", "-y", "makecache"}, "--installroot="+RootDir))
+}
+
+// rpmRepositoryFiles are the repository files of yum and dnf.
+var rpmRepositoryFiles = []string{
+	"/etc/yum.conf",
+	"/etc/yum.repos.d/*",
+	"/etc/dnf/dnf.conf",
+	"/etc/pki/rpm-gpg/*",
+}
+
+func (yum *Yum) RepositoryFiles() []string {
+	return rpmRepositoryFiles
+}
+
+func (yum *Yum) CacheFiles() []string {
+	return []string{"/var/cache/yum/*/*/*/cachecookie"}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"testing"
+)
+
+func TestYumIsAvailable(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"yum info vim-enhanced nginx polpette": `Last metadata expiration check: 0:12:31 ago on Mon 16 Oct 2023 09:12:01 AM UTC.
+Installed Packages
+Name         : vim-enhanced
+Epoch        : 2
+Version      : 9.0.2120
+Release      : 1.fc39
+Architecture : x86_64
+
+Available Packages
+Name         : nginx
+Epoch        : 1
+Version      : 1.24.0
+Release      : 4.fc39
+`,
+	})
+
+	available, err := (&Yum{}).IsAvailable([]PetsPackage{"vim-enhanced", "nginx", "polpette"})
+	assertNoError(t, err)
+	assertEquals(t, available["vim-enhanced"], true)
+	assertEquals(t, available["nginx"], true)
+	assertEquals(t, available["polpette"], false)
+}
+
+func TestYumVersion(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"rpm -q --qf %{NAME}\\t%{VERSION}-%{RELEASE}\\n vim-enhanced nginx": "vim-enhanced\t9.0.2120-1.fc39\npackage nginx is not installed\n",
+	})
+
+	pkgs := []PetsPackage{"vim-enhanced", "nginx"}
+
+	versions, err := (&Yum{}).Version(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, len(versions), 1)
+	assertEquals(t, versions["vim-enhanced"], "9.0.2120-1.fc39")
+
+	installed, err := (&Yum{}).IsInstalled(pkgs)
+	assertNoError(t, err)
+	assertEquals(t, installed["vim-enhanced"], true)
+	assertEquals(t, installed["nginx"], false)
+}
+
+func TestYumCommands(t *testing.T) {
+	assertEquals(t, (&Yum{}).Install([]PetsPackage{"vim-enhanced"}).Args[1], "-y")
+	assertEquals(t, len((&Yum{}).Remove([]PetsPackage{"nano", "telnet"}).Args), 5)
+}
+
+func TestRpmVerCmp(t *testing.T) {
+	assertEquals(t, rpmVerCmp("1.0", "1.0"), 0)
+	assertEquals(t, rpmVerCmp("1.0.1", "1.0") > 0, true)
+	assertEquals(t, rpmVerCmp("1.10", "1.9") > 0, true)
+	assertEquals(t, rpmVerCmp("1.010", "1.10"), 0)
+	assertEquals(t, rpmVerCmp("1.0a", "1.0") > 0, true)
+	assertEquals(t, rpmVerCmp("1.0", "1.a") > 0, true)
+	assertEquals(t, rpmVerCmp("1.0~rc1", "1.0") < 0, true)
+	assertEquals(t, rpmVerCmp("9.0.2120-1.fc39", "9.0.") > 0, true)
+}
+
+func TestYumDowngrade(t *testing.T) {
+	defer ForgetPackages()
+
+	pkgCache["vim-enhanced=9.0.1000-1.fc39"] = &pkgState{Valid: true, Version: "9.0.2120-1.fc39"}
+	pkgCache["nginx=1.24.*"] = &pkgState{Valid: true, Version: "1.22.1-1.fc39"}
+	pkgCache["sudo=1.9.*"] = &pkgState{Valid: true, Version: "1.10.0-1.fc39"}
+
+	cmd := (&Yum{}).Install([]PetsPackage{"vim-enhanced=9.0.1000-1.fc39"})
+	assertEquals(t, cmd.String(), "yum -y downgrade vim-enhanced-9.0.1000-1.fc39")
+
+	cmd = (&Yum{}).Install([]PetsPackage{"nginx=1.24.*"})
+	assertEquals(t, cmd.String(), "yum -y install nginx-1.24.*")
+
+	cmd = (&Yum{}).Install([]PetsPackage{"nginx=1.24.*", "sudo=1.9.*", "polpette"})
+	assertEquals(t, cmd.Args[0], "/bin/sh")
+	assertEquals(t, cmd.Args[2], "'yum' '-y' 'install' 'nginx-1.24.*' 'polpette' && 'yum' '-y' 'downgrade' 'sudo-1.9.*'")
+}
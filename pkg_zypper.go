@@ -0,0 +1,70 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Zypper backend, for openSUSE and SUSE Linux Enterprise.
+
+package main
+
+import (
+	"os/exec"
+)
+
+// Zypper is the PackageManager of SUSE systems.
+type Zypper struct{}
+
+func (zypper *Zypper) Name() string {
+	return "zypper"
+}
+
+func (zypper *Zypper) Detect() bool {
+	return pkgCmdWorks("zypper", "--version")
+}
+
+func (zypper *Zypper) Distros() []string {
+	return []string{"opensuse", "suse", "sles"}
+}
+
+// IsAvailable looks for "Name : pkg" lines in the output of zypper info.
+// Missing packages are reported as "package 'foo' not found."
+func (zypper *Zypper) IsAvailable(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	stdout, err := pkgQuery(withRoot([]string{"zypper", "--non-interactive", "--quiet", "info"}, "--root", RootDir), pkgs)
+	return pkgsFound(pkgs, fieldValues(stdout, "Name")), err
+}
+
+func (zypper *Zypper) IsInstalled(pkgs []PetsPackage) (map[PetsPackage]bool, error) {
+	versions, err := zypper.Version(pkgs)
+	return installedFromVersions(pkgs, versions, err)
+}
+
+func (zypper *Zypper) Version(pkgs []PetsPackage) (map[PetsPackage]string, error) {
+	return rpmVersion(pkgs)
+}
+
+// Install renders versions as pkg=version, allowing downgrades.
+func (zypper *Zypper) Install(pkgs []PetsPackage) *exec.Cmd {
+	args := withRoot([]string{"zypper", "--non-interactive", "install"}, "--root", RootDir)
+	if anyVersion(pkgs) {
+		args = append(args, "--oldpackage")
+	}
+
+	return NewCmd(append(args, versionedArgs(pkgs, "=")...))
+}
+
+func (zypper *Zypper) Remove(pkgs []PetsPackage) *exec.Cmd {
+	return pkgCommand(withRoot([]string{"zypper", "--non-interactive", "remove"}, "--root", RootDir), pkgNames(pkgs))
+}
+
+func (zypper *Zypper) Refresh() *exec.Cmd {
+	return NewCmd(withRoot([]string{"zypper", "--non-interactive", "refresh"}, "--root", RootDir))
+}
+
+func (zypper *Zypper) RepositoryFiles() []string {
+	return []string{
+		"/etc/zypp/zypp.conf",
+		"/etc/zypp/repos.d/*",
+		"/etc/pki/rpm-gpg/*",
+	}
+}
+
+func (zypper *Zypper) CacheFiles() []string {
+	return []string{"/var/cache/zypp/solv/*/solv"}
+}
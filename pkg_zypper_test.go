@@ -0,0 +1,49 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"testing"
+)
+
+func TestZypperIsAvailable(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"zypper --non-interactive --quiet info vim polpette": `
+Information for package vim:
+----------------------------
+Repository     : Main Repository (OSS)
+Name           : vim
+Version        : 9.1.0330-1.1
+Arch           : x86_64
+Vendor         : openSUSE
+Installed      : No
+Status         : not installed
+package 'polpette' not found.
+`,
+	})
+
+	available, err := (&Zypper{}).IsAvailable([]PetsPackage{"vim", "polpette"})
+	assertNoError(t, err)
+	assertEquals(t, available["vim"], true)
+	assertEquals(t, available["polpette"], false)
+}
+
+func TestZypperVersion(t *testing.T) {
+	withPkgOutput(t, map[string]string{
+		"rpm -q --qf %{NAME}\\t%{VERSION}-%{RELEASE}\\n vim": "vim\t9.1.0330-1.1\n",
+	})
+
+	versions, err := (&Zypper{}).Version([]PetsPackage{"vim"})
+	assertNoError(t, err)
+	assertEquals(t, versions["vim"], "9.1.0330-1.1")
+}
+
+func TestZypperCommands(t *testing.T) {
+	cmd := (&Zypper{}).Install([]PetsPackage{"vim"})
+	assertEquals(t, cmd.Args[1], "--non-interactive")
+	assertEquals(t, cmd.Args[2], "install")
+	assertEquals(t, cmd.Args[3], "vim")
+
+	cmd = (&Zypper{}).Remove([]PetsPackage{"telnet"})
+	assertEquals(t, cmd.Args[2], "remove")
+}
@@ -0,0 +1,304 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Saved plans. 'pets plan' writes the list of actions to perform to a file,
+// together with the state of the system the actions are based upon. 'pets
+// apply' reads the file back and performs exactly those actions, unless the
+// state of the system has changed in the meantime.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PetsPlan is the on-disk representation of a list of PetsActions.
+type PetsPlan struct {
+	ConfDir string    `json:"conf_dir"`
+	Root    string    `json:"root,omitempty"`
+	Created time.Time `json:"created"`
+	// Source path of all pets files found in ConfDir
+	Sources  []string         `json:"sources"`
+	Actions  []*PlannedAction `json:"actions"`
+	Files    []*FileState     `json:"files"`
+	Packages []*PackageState  `json:"packages"`
+}
+
+// PlannedAction is the on-disk representation of a PetsAction.
+type PlannedAction struct {
+	Cause  string `json:"cause"`
+	Source string `json:"source,omitempty"`
+	// Full command line, and environment variables set on top of the
+	// inherited ones
+	Command []string `json:"command"`
+	Env     []string `json:"env,omitempty"`
+	// Source path of the files requesting a deferred post-update command
+	Notifiers []string `json:"notifiers,omitempty"`
+	// See PetsAction.Owner
+	Owner string `json:"owner,omitempty"`
+}
+
+// FileState records what a path looked like when the plan was made.
+type FileState struct {
+	Path       string `json:"path"`
+	Exists     bool   `json:"exists"`
+	Mode       string `json:"mode,omitempty"`
+	Uid        uint32 `json:"uid"`
+	Gid        uint32 `json:"gid"`
+	Size       int64  `json:"size"`
+	Sha256     string `json:"sha256,omitempty"`
+	LinkTarget string `json:"link_target,omitempty"`
+}
+
+// PackageState records whether a package was installed when the plan was
+// made, and which version of it.
+type PackageState struct {
+	Name      string `json:"name"`
+	Installed bool   `json:"installed"`
+	Version   string `json:"version,omitempty"`
+}
+
+// NewFileState lstat(2)s the given path and returns its current FileState.
+func NewFileState(path string) *FileState {
+	fs := &FileState{Path: path}
+
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		// Not there, or not accessible. Either way there is nothing more
+		// we can say about it.
+		return fs
+	}
+
+	fs.Exists = true
+	fs.Mode = fileInfo.Mode().String()
+	fs.Size = fileInfo.Size()
+
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		fs.Uid = stat.Uid
+		fs.Gid = stat.Gid
+	}
+
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		fs.LinkTarget, _ = os.Readlink(path)
+	} else if fileInfo.Mode().IsRegular() {
+		fs.Sha256, _ = Sha256(path)
+	}
+
+	return fs
+}
+
+// extraEnv returns the environment variables set on cmd that are not simply
+// inherited from our own environment.
+func extraEnv(cmd *exec.Cmd) []string {
+	if cmd.Env == nil {
+		return nil
+	}
+
+	environ := os.Environ()
+	extra := []string{}
+
+	for _, env := range cmd.Env {
+		if !SliceContains(environ, env) {
+			extra = append(extra, env)
+		}
+	}
+
+	return extra
+}
+
+// NewPetsPlan builds a PetsPlan out of the given actions. All files found in
+// confDir are needed to notice new pets files at apply time, while the valid
+// ones are those whose destinations and packages are recorded.
+func NewPetsPlan(confDir string, files, goodPets []*PetsFile, actions []*PetsAction) *PetsPlan {
+	// The plan may be applied from another working directory
+	if abs, err := filepath.Abs(confDir); err == nil {
+		confDir = abs
+	} else {
+		log.Printf("[ERROR] cannot make %s absolute: %v\n", confDir, err)
+	}
+
+	plan := &PetsPlan{
+		ConfDir:  confDir,
+		Root:     RootDir,
+		Created:  time.Now(),
+		Sources:  []string{},
+		Actions:  []*PlannedAction{},
+		Files:    []*FileState{},
+		Packages: []*PackageState{},
+	}
+
+	for _, action := range actions {
+		planned := &PlannedAction{
+			Cause:   action.Cause.String(),
+			Command: action.Command.Args,
+			Env:     extraEnv(action.Command),
+			Owner:   action.Owner,
+		}
+
+		if action.Trigger != nil {
+			planned.Source = action.Trigger.Source
+		}
+
+		for _, notifier := range action.Notifiers {
+			planned.Notifiers = append(planned.Notifiers, notifier.Source)
+		}
+
+		plan.Actions = append(plan.Actions, planned)
+	}
+
+	seenPaths := make(map[string]bool)
+	addPath := func(path string) {
+		if path != "" && !seenPaths[path] {
+			seenPaths[path] = true
+			plan.Files = append(plan.Files, NewFileState(path))
+		}
+	}
+
+	for _, pf := range files {
+		plan.Sources = append(plan.Sources, pf.Source)
+		addPath(pf.Source)
+	}
+
+	seenPkgs := make(map[PetsPackage]bool)
+
+	for _, pf := range goodPets {
+		addPath(pf.Dest)
+		addPath(pf.Directory)
+
+		// Accounts are planned according to the user and group databases
+		if pf.Account != nil || pf.AccountGroup != nil {
+			addPath(RootPath("/etc/passwd"))
+			addPath(RootPath("/etc/group"))
+		}
+
+		for _, pkg := range append(append([]PetsPackage{}, pf.Pkgs...), pf.AbsentPkgs...) {
+			if !seenPkgs[pkg] {
+				seenPkgs[pkg] = true
+				plan.Packages = append(plan.Packages, &PackageState{
+					Name:      string(pkg),
+					Installed: pkg.IsInstalled(),
+					Version:   pkg.InstalledVersion(),
+				})
+			}
+		}
+	}
+
+	return plan
+}
+
+// Save writes the plan to the given file as JSON.
+func (plan *PetsPlan) Save(fileName string) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, append(data, '\n'), 0644)
+}
+
+// LoadPlan reads a plan previously saved with PetsPlan.Save().
+func LoadPlan(fileName string) (*PetsPlan, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &PetsPlan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	return plan, nil
+}
+
+// CheckStale returns an error describing what changed if the system, or the
+// given pets files, are not in the state they were when the plan was made.
+// It returns nil if the plan can be safely applied.
+func (plan *PetsPlan) CheckStale(files []*PetsFile) error {
+	changes := []string{}
+
+	sources := []string{}
+	for _, pf := range files {
+		sources = append(sources, pf.Source)
+		if !SliceContains(plan.Sources, pf.Source) {
+			changes = append(changes, fmt.Sprintf("new pets file %s", pf.Source))
+		}
+	}
+
+	for _, source := range plan.Sources {
+		if !SliceContains(sources, source) {
+			changes = append(changes, fmt.Sprintf("pets file %s is gone", source))
+		}
+	}
+
+	for _, planned := range plan.Files {
+		if *NewFileState(planned.Path) != *planned {
+			changes = append(changes, fmt.Sprintf("%s changed", planned.Path))
+		}
+	}
+
+	pkgs := []PetsPackage{}
+	for _, planned := range plan.Packages {
+		pkgs = append(pkgs, PetsPackage(planned.Name))
+	}
+	LoadPackages(pkgs)
+
+	for _, planned := range plan.Packages {
+		pkg := PetsPackage(planned.Name)
+		if pkg.IsInstalled() != planned.Installed || pkg.InstalledVersion() != planned.Version {
+			changes = append(changes, fmt.Sprintf("package %s changed", planned.Name))
+		}
+	}
+
+	if len(changes) > 0 {
+		return fmt.Errorf("plan is stale: %s", strings.Join(changes, ", "))
+	}
+
+	return nil
+}
+
+// PetsActions turns the planned actions back into PetsActions. The given
+// files are used to find the Trigger of each action. Unknown causes are an
+// error: running the actions depends on them.
+func (plan *PetsPlan) PetsActions(files []*PetsFile) ([]*PetsAction, error) {
+	bySource := make(map[string]*PetsFile)
+	for _, pf := range files {
+		bySource[pf.Source] = pf
+	}
+
+	actions := []*PetsAction{}
+
+	for _, planned := range plan.Actions {
+		cause, err := ParsePetsCause(planned.Cause)
+		if err != nil {
+			return nil, fmt.Errorf("plan action %v: %v", planned.Command, err)
+		}
+
+		cmd := NewCmd(planned.Command)
+		if len(planned.Env) > 0 {
+			cmd.Env = append(os.Environ(), planned.Env...)
+		}
+
+		action := &PetsAction{
+			Cause:   cause,
+			Command: cmd,
+			Trigger: bySource[planned.Source],
+			Owner:   planned.Owner,
+		}
+
+		for _, notifier := range planned.Notifiers {
+			action.Notifiers = append(action.Notifiers, bySource[notifier])
+		}
+
+		actions = append(actions, action)
+	}
+
+	return actions, nil
+}
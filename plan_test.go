@@ -0,0 +1,91 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanSaveLoad(t *testing.T) {
+	tmpDir := t.TempDir()
+	confDir := filepath.Join(tmpDir, "pets")
+	dest := filepath.Join(tmpDir, "polpette")
+	assertNoError(t, os.Mkdir(confDir, 0755))
+
+	source := filepath.Join(confDir, "polpette")
+	assertNoError(t, os.WriteFile(source, []byte("# pets: destfile="+dest+"\n"), 0644))
+
+	files, err := ParseFiles(confDir)
+	assertNoError(t, err)
+	assertEquals(t, len(files), 1)
+
+	actions := NewPetsActions(files)
+	assertEquals(t, len(actions), 1)
+	assertEquals(t, actions[0].Cause.String(), "FILE_CREATE")
+
+	planFile := filepath.Join(tmpDir, "plan.json")
+	assertNoError(t, NewPetsPlan(confDir, files, files, actions).Save(planFile))
+
+	plan, err := LoadPlan(planFile)
+	assertNoError(t, err)
+	assertEquals(t, plan.ConfDir, confDir)
+	assertNoError(t, plan.CheckStale(files))
+
+	loaded, err := plan.PetsActions(files)
+	assertNoError(t, err)
+	assertEquals(t, len(loaded), 1)
+	assertEquals(t, loaded[0].Cause, actions[0].Cause)
+	assertEquals(t, loaded[0].Trigger, files[0])
+	assertEquals(t, loaded[0].Command.String(), actions[0].Command.String())
+
+	// Unknown causes would change what applying the plan does
+	plan.Actions[0].Cause = "FILE_FROBNICATE"
+	_, err = plan.PetsActions(files)
+	assertError(t, err)
+	plan.Actions[0].Cause = actions[0].Cause.String()
+
+	// Destination created behind our back
+	assertNoError(t, os.WriteFile(dest, []byte("surprise\n"), 0644))
+	assertError(t, plan.CheckStale(files))
+	assertNoError(t, os.Remove(dest))
+	assertNoError(t, plan.CheckStale(files))
+
+	// New pets file
+	other := NewPetsFile()
+	other.Source = filepath.Join(confDir, "other")
+	assertError(t, plan.CheckStale(append(files, other)))
+}
+
+func TestLoadPlanErrors(t *testing.T) {
+	_, err := LoadPlan("very-unlikely-to-find-this.json")
+	assertError(t, err)
+
+	_, err = LoadPlan("README.adoc")
+	assertError(t, err)
+}
+
+func TestPlanPackageVersion(t *testing.T) {
+	stateFile := withFakePackages(t, &FakePackageState{
+		Available: map[string]string{"nginx": "1.24.0-1"},
+		Installed: map[string]string{"nginx": "1.22.1-9"},
+	})
+	t.Cleanup(ForgetPackages)
+	ForgetPackages()
+
+	pf := NewPetsFile()
+	pf.Source = "/etc/pets/nginx"
+	pf.Pkgs = []PetsPackage{"nginx"}
+	files := []*PetsFile{pf}
+
+	plan := NewPetsPlan("sample_pet", files, files, []*PetsAction{})
+	assertEquals(t, filepath.IsAbs(plan.ConfDir), true)
+	assertEquals(t, plan.Packages[0].Version, "1.22.1-9")
+	assertNoError(t, plan.CheckStale(files))
+
+	// Upgraded behind our back
+	assertEquals(t, FakePackageMain([]string{stateFile, "install", "nginx"}), 0)
+	ForgetPackages()
+	assertError(t, plan.CheckStale(files))
+}
@@ -7,36 +7,74 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // PetsCause conveys the reason behind a given action.
 type PetsCause int
 
 const (
-	NONE   = iota // no reason at all
-	PKG           // required package is missing
-	CREATE        // configuration file is missing and needs to be created
-	UPDATE        // configuration file differs and needs to be updated
-	LINK          // symbolic link needs to be created
-	DIR           // directory needs to be created
-	OWNER         // needs chown()
-	MODE          // needs chmod()
-	POST          // post-update command
+	NONE         = iota // no reason at all
+	PKG                 // required package is missing
+	CREATE              // configuration file is missing and needs to be created
+	UPDATE              // configuration file differs and needs to be updated
+	LINK                // symbolic link needs to be created
+	DIR                 // directory needs to be created
+	OWNER               // needs chown()
+	MODE                // needs chmod()
+	POST                // post-update command
+	PKG_REMOVE          // package that should not be there is installed
+	PKG_REFRESH         // package cache needs to be refreshed
+	USER_CREATE         // user needs to be created
+	USER_UPDATE         // user exists with different properties
+	GROUP_CREATE        // group needs to be created
+	GROUP_UPDATE        // group exists with a different gid
+	SERVICE             // service is not in the requested state
+	DELETE              // file that should not be there exists
+	ACL                 // ACL lacks some entries
+	XATTR               // extended attribute is missing or differs
+	REPLACE             // something else is in the way of a symbolic link
 )
 
+var petsCauseNames = map[PetsCause]string{
+	PKG:          "PACKAGE_INSTALL",
+	PKG_REMOVE:   "PACKAGE_REMOVE",
+	PKG_REFRESH:  "PACKAGE_REFRESH",
+	CREATE:       "FILE_CREATE",
+	UPDATE:       "FILE_UPDATE",
+	LINK:         "LINK_CREATE",
+	DIR:          "DIR_CREATE",
+	OWNER:        "OWNER",
+	MODE:         "CHMOD",
+	POST:         "POST_UPDATE",
+	USER_CREATE:  "USER_CREATE",
+	USER_UPDATE:  "USER_UPDATE",
+	GROUP_CREATE: "GROUP_CREATE",
+	GROUP_UPDATE: "GROUP_UPDATE",
+	SERVICE:      "SERVICE",
+	DELETE:       "FILE_DELETE",
+	ACL:          "ACL",
+	XATTR:        "XATTR",
+	REPLACE:      "LINK_REPLACE",
+}
+
 func (pc PetsCause) String() string {
-	return map[PetsCause]string{
-		PKG:    "PACKAGE_INSTALL",
-		CREATE: "FILE_CREATE",
-		UPDATE: "FILE_UPDATE",
-		LINK:   "LINK_CREATE",
-		DIR:    "DIR_CREATE",
-		OWNER:  "OWNER",
-		MODE:   "CHMOD",
-		POST:   "POST_UPDATE",
-	}[pc]
+	return petsCauseNames[pc]
+}
+
+// ParsePetsCause is the inverse of PetsCause.String()
+func ParsePetsCause(name string) (PetsCause, error) {
+	for cause, causeName := range petsCauseNames {
+		if causeName == name {
+			return cause, nil
+		}
+	}
+	return NONE, fmt.Errorf("unknown cause '%s'", name)
 }
 
 // A PetsAction represents something to be done, namely running a certain
@@ -45,6 +83,25 @@ type PetsAction struct {
 	Cause   PetsCause
 	Command *exec.Cmd
 	Trigger *PetsFile
+	// For deferred post-update commands and service actions: all the files
+	// requesting the command, Trigger being the first one
+	Notifiers []*PetsFile
+	// Package cache refresh ending the early phase, see RunPhases
+	EarlyRefresh bool
+	// For OWNER actions: the owner and group being set, with both their ids
+	// and names if known. Eg: uid 33 (www-data), gid 33 (www-data)
+	Owner string
+	// Outcome of Perform(), nil if the action has not been performed
+	Result *PetsActionResult
+}
+
+// PetsActionResult holds what happened when running the Command of a
+// PetsAction.
+type PetsActionResult struct {
+	ExitStatus int
+	Stdout     string
+	Stderr     string
+	Duration   time.Duration
 }
 
 // String representation of a PetsAction
@@ -56,10 +113,19 @@ func (pa *PetsAction) String() string {
 	}
 }
 
-// Perform executes the Command
+// Perform executes the Command and stores its outcome in Result
 func (pa *PetsAction) Perform() error {
+	startTime := time.Now()
+
 	stdout, stderr, err := RunCmd(pa.Command)
 
+	pa.Result = &PetsActionResult{
+		ExitStatus: ExitStatus(err),
+		Stdout:     stdout,
+		Stderr:     stderr,
+		Duration:   time.Since(startTime),
+	}
+
 	if err != nil {
 		log.Printf("[ERROR] running Perform() -> %v\n", err)
 	}
@@ -79,37 +145,65 @@ func (pa *PetsAction) Perform() error {
 // true if there are any new packages to install, the latter is the
 // distro-specific command to run to install the packages.
 func PkgsToInstall(triggers []*PetsFile) (bool, *exec.Cmd) {
-	installPkgs := false
-	installCmd := InstallCommand()
+	pkgs := []PetsPackage{}
+	marked := make(map[PetsPackage]bool)
 
 	for _, trigger := range triggers {
 		for _, pkg := range trigger.Pkgs {
-			if SliceContains(installCmd.Args, string(pkg)) {
+			if marked[pkg] {
 				log.Printf("[DEBUG] %s already marked to be installed\n", pkg)
 			} else if pkg.IsInstalled() {
 				log.Printf("[DEBUG] %s already installed\n", pkg)
 			} else {
 				log.Printf("[INFO] %s not installed\n", pkg)
-				installCmd.Args = append(installCmd.Args, string(pkg))
-				installPkgs = true
+				pkgs = append(pkgs, pkg)
+				marked[pkg] = true
 			}
 		}
 	}
 
-	return installPkgs, installCmd
+	return len(pkgs) > 0, WhichPackageManager().Install(pkgs)
 }
 
-// FileToCopy figures out if the given trigger represents a file that needs to
-// be updated, and returns the corresponding PetsAction.
-func FileToCopy(trigger *PetsFile) *PetsAction {
-	if trigger.Link {
-		return nil
+// PkgsToRemove is the PkgsToInstall counterpart for packages that should not
+// be installed. All packages are removed with a single command.
+func PkgsToRemove(triggers []*PetsFile) (bool, *exec.Cmd) {
+	pkgs := []PetsPackage{}
+	marked := make(map[PetsPackage]bool)
+
+	for _, trigger := range triggers {
+		for _, pkg := range trigger.AbsentPkgs {
+			// Versions do not matter here, any version has to go
+			pkg = PetsPackage(pkg.Name())
+
+			if marked[pkg] {
+				log.Printf("[DEBUG] %s already marked to be removed\n", pkg)
+			} else if pkg.InstalledVersion() == "" {
+				log.Printf("[DEBUG] %s not installed\n", pkg)
+			} else {
+				log.Printf("[INFO] %s installed, but should not be\n", pkg)
+				pkgs = append(pkgs, pkg)
+				marked[pkg] = true
+			}
+		}
 	}
 
-	cause := trigger.NeedsCopy()
+	return len(pkgs) > 0, WhichPackageManager().Remove(pkgs)
+}
 
-	if cause == NONE {
+// FileToCopy figures out if the given trigger represents a file that needs to
+// be updated, and returns the corresponding PetsAction. cause is the result of
+// trigger.NeedsCopy().
+func FileToCopy(trigger *PetsFile, cause PetsCause) *PetsAction {
+	if trigger.Link || cause == NONE {
 		return nil
+	} else if cause == REPLACE {
+		// The symbolic link in the way has been moved by FileToReplace
+		return &PetsAction{
+			Cause:   CREATE,
+			Command: NewCmd([]string{"/bin/cp", trigger.Source, trigger.Dest}),
+			Trigger: trigger,
+		}
 	} else {
 		return &PetsAction{
 			Cause:   cause,
@@ -120,25 +214,100 @@ func FileToCopy(trigger *PetsFile) *PetsAction {
 }
 
 // LinkToCreate figures out if the given trigger represents a symbolic link
-// that needs to be created, and returns the corresponding PetsAction.
-func LinkToCreate(trigger *PetsFile) *PetsAction {
-	if !trigger.Link {
-		return nil
-	}
-
-	cause := trigger.NeedsLink()
-
-	if cause == NONE {
+// that needs to be created, and returns the corresponding PetsAction. cause is
+// the result of trigger.NeedsLink().
+func LinkToCreate(trigger *PetsFile, cause PetsCause) *PetsAction {
+	if !trigger.Link || cause == NONE {
 		return nil
 	} else {
+		// Whatever was in the way has been moved by LinkToReplace
 		return &PetsAction{
-			Cause:   cause,
-			Command: NewCmd([]string{"/bin/ln", "-s", trigger.Source, trigger.Dest}),
+			Cause:   LINK,
+			Command: NewCmd([]string{"/bin/ln", "-s", trigger.LinkTarget(), trigger.Dest}),
 			Trigger: trigger,
 		}
 	}
 }
 
+// BackupDir is where files that have to be absent are moved to, keeping their
+// full path and adding a timestamp. Eg: /etc/cron.d/old-job becomes
+// /var/backups/pets/etc/cron.d/old-job.20221019-071400
+var BackupDir = "/var/backups/pets"
+
+// BackupPath returns the path under BackupDir where the given destination
+// file is moved to. Existing backups are never reused: a counter is added to
+// the timestamp if needed.
+func BackupPath(dest string) string {
+	backup := filepath.Join(RootPath(BackupDir), strings.TrimPrefix(dest, RootDir))
+	backup += "." + time.Now().Format("20060102-150405")
+
+	path := backup
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = fmt.Sprintf("%s-%d", backup, i)
+	}
+}
+
+// FileToDelete figures out if the given trigger represents a file that has to
+// be absent, and returns the PetsActions needed to move it out of the way.
+func FileToDelete(trigger *PetsFile) []*PetsAction {
+	if trigger.NeedsDelete() == NONE {
+		return []*PetsAction{}
+	}
+
+	log.Printf("[INFO] %s exists, but should not\n", trigger.Dest)
+	return backupDest(trigger, DELETE)
+}
+
+// LinkToReplace figures out if the given trigger represents a symbolic link
+// that has to replace whatever is at its destination, and returns the
+// PetsActions needed to move that out of the way. LinkToCreate takes care of
+// creating the link afterwards. cause is the result of trigger.NeedsLink().
+func LinkToReplace(trigger *PetsFile, cause PetsCause) []*PetsAction {
+	if cause != REPLACE {
+		return []*PetsAction{}
+	}
+
+	log.Printf("[INFO] replacing %s with a symlink to %s\n", trigger.Dest, trigger.Source)
+	return backupDest(trigger, REPLACE)
+}
+
+// FileToReplace returns the PetsActions needed to move the symbolic link at
+// the destination of the given trigger out of the way, if it has to be
+// replaced by the file. cause is the result of trigger.NeedsCopy().
+func FileToReplace(trigger *PetsFile, cause PetsCause) []*PetsAction {
+	if trigger.Link || cause != REPLACE {
+		return []*PetsAction{}
+	}
+
+	return backupDest(trigger, REPLACE)
+}
+
+// backupDest returns the PetsActions needed to move the destination of the
+// given trigger to BackupPath: creating the backup directory, if missing, and
+// moving the file there.
+func backupDest(trigger *PetsFile, cause PetsCause) []*PetsAction {
+	actions := []*PetsAction{}
+
+	backup := BackupPath(trigger.Dest)
+
+	if _, err := os.Stat(filepath.Dir(backup)); os.IsNotExist(err) {
+		actions = append(actions, &PetsAction{
+			Cause:   DIR,
+			Command: NewCmd([]string{"/bin/mkdir", "-p", filepath.Dir(backup)}),
+			Trigger: trigger,
+		})
+	}
+
+	return append(actions, &PetsAction{
+		Cause:   cause,
+		Command: NewCmd([]string{"/bin/mv", trigger.Dest, backup}),
+		Trigger: trigger,
+	})
+}
+
 // DirToCreate figures out if the given trigger represents a directory that
 // needs to be created, and returns the corresponding PetsAction.
 func DirToCreate(trigger *PetsFile) *PetsAction {
@@ -161,112 +330,351 @@ func DirToCreate(trigger *PetsFile) *PetsAction {
 
 // Chown returns a chown PetsAction or nil if none is needed.
 func Chown(trigger *PetsFile) *PetsAction {
-	// Build arg (eg: 'root:staff', 'root', ':staff')
-	arg := ""
-	var wantUid, wantGid int
-	var err error
+	if (trigger.Owner == "" && trigger.OwnerGroup == "") || trigger.Dest == "" || trigger.Absent {
+		// Return immediately if the file had no 'owner' / 'group' directives
+		return nil
+	}
 
-	if trigger.User != nil {
-		arg = trigger.User.Username
+	// Accounts that do not exist yet are expected to be created by a package
+	// or by a 'user' directive before the chown runs
+	resolved := trigger.ResolveOwner() == nil
 
-		// get the requested uid as integer
-		wantUid, err = strconv.Atoi(trigger.User.Uid)
-		if err != nil {
-			// This should really never ever happen, unless we're
-			// running on Windows. :)
-			panic(err)
-		}
+	if symlinkAtDest(trigger) && !trigger.Force {
+		log.Printf("[ERROR] %s is a symbolic link, not changing the owner of its target\n", trigger.Dest)
+		return nil
 	}
 
-	if trigger.Group != nil {
-		arg = fmt.Sprintf("%s:%s", arg, trigger.Group.Name)
+	return chownPath(trigger, trigger.Dest, trigger.Owner, trigger.OwnerGroup, trigger.User, trigger.Group, resolved)
+}
 
-		// get the requested gid as integer
-		wantGid, err = strconv.Atoi(trigger.Group.Gid)
-		if err != nil {
-			panic(err)
-		}
+// chownsDest returns true if the given OWNER action changes the owner of the
+// destination of its trigger, as opposed to one of its directories.
+func chownsDest(action *PetsAction) bool {
+	path := action.Command.Args[len(action.Command.Args)-1]
+	return path == action.Trigger.Dest || path == strings.TrimPrefix(action.Trigger.Dest, RootDir)
+}
+
+// isSymlink returns true if path is a symbolic link.
+func isSymlink(path string) bool {
+	fileInfo, err := os.Lstat(path)
+	return err == nil && fileInfo.Mode()&os.ModeSymlink != 0
+}
+
+// symlinkAtDest returns true if the given trigger is a file to copy, and there
+// is a symbolic link at its destination. With force, the link is replaced by
+// the file, which is then handled as if it did not exist yet.
+func symlinkAtDest(trigger *PetsFile) bool {
+	return !trigger.Link && !trigger.Absent && isSymlink(trigger.Dest)
+}
+
+// chownPath returns a PetsAction to chown the given path to owner and group,
+// or nil if none is needed. wantUser and wantGroup are the resolved owner and
+// group, if any.
+func chownPath(trigger *PetsFile, path, owner, group string, wantUser *user.User, wantGroup *user.Group, resolved bool) *PetsAction {
+	// Build arg (eg: 'root:staff', 'root', ':staff')
+	arg := owner
+	if group != "" {
+		arg = fmt.Sprintf("%s:%s", arg, group)
 	}
 
-	if arg == "" {
-		// Return immediately if the file had no 'owner' / 'group' directives
-		return nil
+	// Symbolic links are chowned themselves, and not their target which is
+	// likely to be in the configuration directory
+	chown := []string{"/bin/chown"}
+	stat := os.Stat
+	if trigger.Link && path == trigger.Dest {
+		chown = []string{"/bin/chown", "-h"}
+		stat = os.Lstat
+	}
+
+	command := append(append([]string{}, chown...), arg, path)
+
+	// With an alternate root, names are looked up in its user database and
+	// not in the one chown(1) would use: pass numeric ids instead, or run
+	// chown in the root if they are not known yet
+	if RootDir != "" {
+		if resolved {
+			arg = ""
+			if wantUser != nil {
+				arg = wantUser.Uid
+			}
+			if wantGroup != nil {
+				arg = fmt.Sprintf("%s:%s", arg, wantGroup.Gid)
+			}
+			command = append(append([]string{}, chown...), arg, path)
+		} else {
+			command = append(append([]string{"chroot", RootDir}, chown...), arg, strings.TrimPrefix(path, RootDir))
+		}
 	}
 
 	// The action to (possibly) perform is a chown of the file.
 	action := &PetsAction{
 		Cause:   OWNER,
-		Command: NewCmd([]string{"/bin/chown", arg, trigger.Dest}),
+		Command: NewCmd(command),
 		Trigger: trigger,
+		Owner:   describeOwner(wantUser, wantGroup),
+	}
+
+	if !resolved {
+		action.Owner = arg
+		log.Printf("[INFO] owner of %s not known yet, chown to %s later on\n", path, arg)
+		return action
 	}
 
 	// stat(2) the destination file to see if a chown is needed
-	fileInfo, err := os.Stat(trigger.Dest)
-	if os.IsNotExist(err) {
+	fileInfo, err := stat(path)
+	if os.IsNotExist(err) || (path == trigger.Dest && symlinkAtDest(trigger)) {
 		// If the destination file is not there yet, prepare a chown
 		// for later on.
+		log.Printf("[INFO] %s is going to be owned by %s\n", path, describeOwner(wantUser, wantGroup))
 		return action
 	}
 
-	stat, _ := fileInfo.Sys().(*syscall.Stat_t)
+	sys, _ := fileInfo.Sys().(*syscall.Stat_t)
 
-	if trigger.User != nil && int(stat.Uid) != wantUid {
-		log.Printf("[INFO] %s is owned by uid %d instead of %s\n", trigger.Dest, stat.Uid, trigger.User.Username)
+	if wantUser != nil && strconv.Itoa(int(sys.Uid)) != wantUser.Uid {
+		log.Printf("[INFO] %s is owned by uid %d instead of %s\n", path, sys.Uid, DescribeId(wantUser.Uid, wantUser.Username))
 		return action
 	}
 
-	if trigger.Group != nil && int(stat.Gid) != wantGid {
-		log.Printf("[INFO] %s is owned by gid %d instead of %s\n", trigger.Dest, stat.Gid, trigger.Group.Name)
+	if wantGroup != nil && strconv.Itoa(int(sys.Gid)) != wantGroup.Gid {
+		log.Printf("[INFO] %s is owned by gid %d instead of %s\n", path, sys.Gid, DescribeId(wantGroup.Gid, wantGroup.Name))
 		return action
 	}
 
-	log.Printf("[DEBUG] %s is owned by %d:%d already\n", trigger.Dest, stat.Uid, stat.Gid)
+	log.Printf("[DEBUG] %s is owned by %d:%d already\n", path, sys.Uid, sys.Gid)
 	return nil
 }
 
+// describeOwner returns the given uid and gid, along with their names if
+// known.
+func describeOwner(wantUser *user.User, wantGroup *user.Group) string {
+	owner := []string{}
+
+	if wantUser != nil {
+		owner = append(owner, "uid "+DescribeId(wantUser.Uid, wantUser.Username))
+	}
+
+	if wantGroup != nil {
+		owner = append(owner, "gid "+DescribeId(wantGroup.Gid, wantGroup.Name))
+	}
+
+	return strings.Join(owner, ", ")
+}
+
 // Chmod returns a chmod PetsAction or nil if none is needed.
 func Chmod(trigger *PetsFile) *PetsAction {
-	if trigger.Mode == "" {
+	if trigger.Mode == "" || trigger.Dest == "" || trigger.Absent || trigger.Link {
 		// Return immediately if the 'mode' directive was not specified.
+		// Symbolic links have no mode, the validator refuses it.
 		return nil
 	}
 
+	if symlinkAtDest(trigger) && !trigger.Force {
+		log.Printf("[ERROR] %s is a symbolic link, not changing the mode of its target\n", trigger.Dest)
+		return nil
+	}
+
+	mode := trigger.Mode
+
+	// With named ACL entries, the group permissions shown by stat(2) and
+	// changed by chmod(1) are those of the ACL mask. The permissions of the
+	// owning group are set by SetACL.
+	if len(trigger.ACL) > 0 {
+		fileMode, err := StringToFileMode(mode)
+		if err != nil {
+			log.Println("[ERROR] unexpected error in Chmod()", err)
+			return nil
+		}
+		mode = fmt.Sprintf("%04o", uint32(ACLMode(trigger.Dest, fileMode, trigger.ACL)))
+	}
+
+	return chmodPath(trigger, trigger.Dest, mode)
+}
+
+// chmodPath returns a PetsAction to chmod the given path, or nil if none is
+// needed.
+func chmodPath(trigger *PetsFile, path, mode string) *PetsAction {
 	// The action to (possibly) perform is a chmod of the file.
 	action := &PetsAction{
 		Cause:   MODE,
-		Command: NewCmd([]string{"/bin/chmod", trigger.Mode, trigger.Dest}),
+		Command: NewCmd([]string{"/bin/chmod", mode, path}),
 		Trigger: trigger,
 	}
 
 	// stat(2) the destination file to see if a chmod is needed
-	fileInfo, err := os.Stat(trigger.Dest)
-	if os.IsNotExist(err) {
+	fileInfo, err := os.Stat(path)
+	if os.IsNotExist(err) || (path == trigger.Dest && symlinkAtDest(trigger)) {
 		// If the destination file is not there yet, prepare a mod
 		// for later on.
 		return action
 	}
 
 	// See if the desired mode and reality differ.
-	newMode, err := StringToFileMode(trigger.Mode)
+	newMode, err := StringToFileMode(mode)
 	if err != nil {
 		log.Println("[ERROR] unexpected error in Chmod()", err)
 		return nil
 	}
 
-	oldMode := fileInfo.Mode()
+	// Directories have os.ModeDir set, which is not part of the mode
+	oldMode := fileInfo.Mode() &^ os.ModeDir
 
 	if oldMode != newMode {
-		log.Printf("[INFO] %s is %s instead of %s\n", trigger.Dest, oldMode, newMode)
+		log.Printf("[INFO] %s is %s instead of %s\n", path, oldMode, newMode)
 		return action
 	}
 
-	log.Printf("[DEBUG] %s is %s already\n", trigger.Dest, newMode)
+	log.Printf("[DEBUG] %s is %s already\n", path, newMode)
 	return nil
 }
 
+// missingDirs returns the given directory and its parents which do not exist,
+// starting from the topmost one. Those are the directories mkdir -p creates.
+func missingDirs(dir string) []string {
+	missing := []string{}
+
+	for ; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			break
+		}
+		missing = append([]string{dir}, missing...)
+	}
+
+	return missing
+}
+
+// DirPermissions returns the chown and chmod PetsActions needed for the
+// directories created by DirToCreate to have DirOwner, DirOwnerGroup and
+// DirMode. If DirEnforce is set, they are applied to an existing Directory
+// too.
+func DirPermissions(trigger *PetsFile) []*PetsAction {
+	actions := []*PetsAction{}
+
+	if trigger.Directory == "" || trigger.Absent {
+		return actions
+	}
+
+	dirs := missingDirs(trigger.Directory)
+	if len(dirs) == 0 && trigger.DirEnforce {
+		dirs = []string{trigger.Directory}
+	}
+
+	resolved := trigger.ResolveDirOwner() == nil
+
+	for _, dir := range dirs {
+		if trigger.DirOwner != "" || trigger.DirOwnerGroup != "" {
+			if chown := chownPath(trigger, dir, trigger.DirOwner, trigger.DirOwnerGroup, trigger.DirUser, trigger.DirGroup, resolved); chown != nil {
+				actions = append(actions, chown)
+			}
+		}
+
+		if trigger.DirMode != "" {
+			if chmod := chmodPath(trigger, dir, trigger.DirMode); chmod != nil {
+				actions = append(actions, chmod)
+			}
+		}
+	}
+
+	return actions
+}
+
+// SortPetsFiles returns the given files sorted so that each file comes after
+// all the files listed in its AfterFiles. Files without dependencies between
+// them keep their original order. An error is returned if there are
+// dependency cycles.
+func SortPetsFiles(files []*PetsFile) ([]*PetsFile, error) {
+	sorted := []*PetsFile{}
+	done := make(map[*PetsFile]bool)
+
+	// Dependencies on files we are not asked to sort, for instance because
+	// they are invalid, are ignored.
+	pending := make(map[*PetsFile]bool)
+	for _, pf := range files {
+		pending[pf] = true
+	}
+
+	for len(sorted) < len(files) {
+		progress := false
+
+		for _, pf := range files {
+			if done[pf] {
+				continue
+			}
+
+			ready := true
+			for _, other := range pf.AfterFiles {
+				if pending[other] && !done[other] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				sorted = append(sorted, pf)
+				done[pf] = true
+				progress = true
+				// Start over to preserve the original order as much as
+				// possible
+				break
+			}
+		}
+
+		if !progress {
+			cycle := []string{}
+			for _, pf := range files {
+				if !done[pf] {
+					cycle = append(cycle, pf.Source)
+				}
+			}
+			return nil, fmt.Errorf("[ERROR] dependency cycle between %v\n", cycle)
+		}
+	}
+
+	return sorted, nil
+}
+
+// SplitPhases returns the files to apply before refreshing the package cache,
+// and all the others, keeping their order.
+func SplitPhases(files []*PetsFile) ([]*PetsFile, []*PetsFile) {
+	early, late := []*PetsFile{}, []*PetsFile{}
+
+	for _, pf := range files {
+		if pf.IsEarly() {
+			early = append(early, pf)
+		} else {
+			late = append(late, pf)
+		}
+	}
+
+	return early, late
+}
+
+// ChangedFiles returns the given files that are going to be created or
+// modified. If any early file changes, the package cache must be refreshed
+// before looking at the packages of the other files.
+func ChangedFiles(files []*PetsFile) []*PetsFile {
+	changed := []*PetsFile{}
+	for _, pf := range files {
+		if pf.NeedsCopy() != NONE || pf.NeedsLink() != NONE || pf.NeedsDelete() != NONE {
+			changed = append(changed, pf)
+		}
+	}
+	return changed
+}
+
 // NewPetsActions is the []PetsFile -> []PetsAction constructor.  Given a slice
 // of PetsFile(s), generate a list of PetsActions to perform.
 func NewPetsActions(triggers []*PetsFile) []*PetsAction {
+	actions, handlers := newPetsActions(triggers)
+
+	// Deferred post-update commands go last, so that all files are in place
+	// by the time services are reloaded.
+	return append(actions, handlers...)
+}
+
+// newPetsActions is NewPetsActions, returning the deferred post-update
+// commands separately.
+func newPetsActions(triggers []*PetsFile) ([]*PetsAction, []*PetsAction) {
 	actions := []*PetsAction{}
 
 	// First, install all needed packages. Build a list of all missing package
@@ -274,14 +682,61 @@ func NewPetsActions(triggers []*PetsFile) []*PetsAction {
 	// embarassing things like running in a loop apt install pkg1 ; apt install
 	// pkg2 ; apt install pkg3 like some configuration management systems do.
 	if installPkgs, installCmd := PkgsToInstall(triggers); installPkgs {
+		// Installing from an old package index fails, or installs old
+		// versions
+		if refreshCmd := WhichPackageManager().Refresh(); refreshCmd != nil && PackageCacheStale() {
+			actions = append(actions, &PetsAction{
+				Cause:   PKG_REFRESH,
+				Command: refreshCmd,
+			})
+		}
+
 		actions = append(actions, &PetsAction{
 			Cause:   PKG,
 			Command: installCmd,
 		})
 	}
 
+	// Same for packages to remove
+	if removePkgs, removeCmd := PkgsToRemove(triggers); removePkgs {
+		actions = append(actions, &PetsAction{
+			Cause:   PKG_REMOVE,
+			Command: removeCmd,
+		})
+	}
+
+	// Apply files in dependency order. The validator already checked that
+	// there are no cycles.
+	sorted, err := SortPetsFiles(triggers)
+	if err != nil {
+		log.Println(err)
+	} else {
+		triggers = sorted
+	}
+
+	// Users and groups need to be there before files are chowned to them.
+	// Groups first, as users may be added to them.
+	accountFired := make(map[*PetsFile]bool)
+
+	for _, trigger := range triggers {
+		if groupAction := GroupAction(trigger); groupAction != nil {
+			actions = append(actions, groupAction)
+			accountFired[trigger] = true
+		}
+	}
+
 	for _, trigger := range triggers {
-		actionFired := false
+		if userAction := UserAction(trigger); userAction != nil {
+			actions = append(actions, userAction)
+			accountFired[trigger] = true
+		}
+	}
+
+	// Post-update commands to run at the end
+	handlers := []*PetsAction{}
+
+	for _, trigger := range triggers {
+		actionFired := accountFired[trigger]
 
 		// Any directory to create
 		if dirAction := DirToCreate(trigger); dirAction != nil {
@@ -289,14 +744,41 @@ func NewPetsActions(triggers []*PetsFile) []*PetsAction {
 			actionFired = true
 		}
 
+		// Ownership and mode of the directories
+		if dirActions := DirPermissions(trigger); len(dirActions) > 0 {
+			actions = append(actions, dirActions...)
+			actionFired = true
+		}
+
+		// Files that should not be there
+		if deleteActions := FileToDelete(trigger); len(deleteActions) > 0 {
+			actions = append(actions, deleteActions...)
+			actionFired = true
+		}
+
+		// Symbolic links in the way of a file
+		copyCause := trigger.NeedsCopy()
+		if replaceActions := FileToReplace(trigger, copyCause); len(replaceActions) > 0 {
+			actions = append(actions, replaceActions...)
+			actionFired = true
+		}
+
 		// Then, figure out which files need to be modified/created.
-		if fileAction := FileToCopy(trigger); fileAction != nil {
+		if fileAction := FileToCopy(trigger, copyCause); fileAction != nil {
 			actions = append(actions, fileAction)
 			actionFired = true
 		}
 
+		// Anything in the way of a symlink. Moving it changes what
+		// NeedsLink returns, so look only once.
+		linkCause := trigger.NeedsLink()
+		if replaceActions := LinkToReplace(trigger, linkCause); len(replaceActions) > 0 {
+			actions = append(actions, replaceActions...)
+			actionFired = true
+		}
+
 		// Any symlink to create
-		if linkAction := LinkToCreate(trigger); linkAction != nil {
+		if linkAction := LinkToCreate(trigger, linkCause); linkAction != nil {
 			actions = append(actions, linkAction)
 			actionFired = true
 		}
@@ -313,12 +795,96 @@ func NewPetsActions(triggers []*PetsFile) []*PetsAction {
 			actionFired = true
 		}
 
-		// Finally, post-update commands
+		// ACLs after chmod, which only changes their mask
+		if acl := SetACL(trigger); acl != nil {
+			actions = append(actions, acl)
+			actionFired = true
+		}
+
+		// Any extended attributes
+		if xattrActions := SetXattrs(trigger); len(xattrActions) > 0 {
+			actions = append(actions, xattrActions...)
+			actionFired = true
+		}
+
+		// Finally, post-update commands. They would act on the live system
+		// instead of the alternate root.
 		if trigger.Post != nil && actionFired {
-			actions = append(actions, &PetsAction{
-				Cause:   POST,
-				Command: trigger.Post,
-			})
+			if RootDir != "" {
+				log.Printf("[INFO] not running post-update command '%s' of %s in %s\n", trigger.Post, trigger.Source, RootDir)
+			} else if trigger.PostImmediate {
+				actions = append(actions, &PetsAction{
+					Cause:   POST,
+					Command: trigger.Post,
+					Trigger: trigger,
+				})
+			} else {
+				handlers = AddHandler(handlers, trigger)
+			}
+		}
+	}
+
+	// Services are started once their configuration is in place, and
+	// before they are reloaded by deferred post-update commands. Files may
+	// ask for the same state of the same service, do it only once unless
+	// all of them fail.
+	seenServices := make(map[string]*PetsAction)
+
+	for _, trigger := range triggers {
+		for _, serviceAction := range ServiceActions(trigger) {
+			if seen, ok := seenServices[serviceAction.Command.String()]; ok {
+				seen.Notifiers = append(seen.Notifiers, trigger)
+				continue
+			}
+
+			serviceAction.Notifiers = []*PetsFile{trigger}
+			seenServices[serviceAction.Command.String()] = serviceAction
+			actions = append(actions, serviceAction)
+		}
+	}
+
+	return actions, handlers
+}
+
+// AddHandler adds the post-update command of the given trigger to the list of
+// deferred ones, unless an identical command is there already. In that case,
+// the trigger is only added to the Notifiers of the existing action. This way
+// each command runs only once, in the order it was first requested.
+func AddHandler(handlers []*PetsAction, trigger *PetsFile) []*PetsAction {
+	for _, handler := range handlers {
+		if handler.Command.String() == trigger.Post.String() {
+			log.Printf("[DEBUG] %s: post-update command '%s' already scheduled\n", trigger.Source, trigger.Post)
+			handler.Notifiers = append(handler.Notifiers, trigger)
+			return handlers
+		}
+	}
+
+	return append(handlers, &PetsAction{
+		Cause:     POST,
+		Command:   trigger.Post,
+		Trigger:   trigger,
+		Notifiers: []*PetsFile{trigger},
+	})
+}
+
+// MergeHandlers adds the given deferred post-update commands to actions. The
+// Notifiers of commands scheduled already are merged, so that each command
+// still runs only once.
+func MergeHandlers(actions, handlers []*PetsAction) []*PetsAction {
+	for _, handler := range handlers {
+		merged := false
+
+		for _, action := range actions {
+			if action.Cause == POST && len(action.Notifiers) > 0 && action.Command.String() == handler.Command.String() {
+				log.Printf("[DEBUG] post-update command '%s' already scheduled\n", handler.Command)
+				action.Notifiers = append(action.Notifiers, handler.Notifiers...)
+				merged = true
+				break
+			}
+		}
+
+		if !merged {
+			actions = append(actions, handler)
 		}
 	}
 
@@ -3,6 +3,10 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
 	"testing"
 )
 
@@ -30,7 +34,7 @@ func TestFileToCopy(t *testing.T) {
 	pf, err := NewTestFile("sample_pet/ssh/sshd_config", "ssh", "sample_pet/ssh/sshd_config", "root", "root", "0640", "", "")
 	assertNoError(t, err)
 
-	pa := FileToCopy(pf)
+	pa := FileToCopy(pf, pf.NeedsCopy())
 	if pa != nil {
 		t.Errorf("Expecting nil, got %v instead", pa)
 	}
@@ -38,7 +42,7 @@ func TestFileToCopy(t *testing.T) {
 	pf, err = NewTestFile("sample_pet/ssh/sshd_config", "ssh", "/tmp/polpette", "root", "root", "0640", "", "")
 	assertNoError(t, err)
 
-	pa = FileToCopy(pf)
+	pa = FileToCopy(pf, pf.NeedsCopy())
 	if pa == nil {
 		t.Errorf("Expecting a PetsAction, got nil instead")
 	}
@@ -48,7 +52,7 @@ func TestFileToCopy(t *testing.T) {
 	pf, err = NewTestFile("sample_pet/ssh/sshd_config", "ssh", "sample_pet/ssh/user_ssh_config", "root", "root", "0640", "", "")
 	assertNoError(t, err)
 
-	pa = FileToCopy(pf)
+	pa = FileToCopy(pf, pf.NeedsCopy())
 	if pa == nil {
 		t.Errorf("Expecting a PetsAction, got nil instead")
 	}
@@ -108,6 +112,25 @@ func TestChown(t *testing.T) {
 
 	assertEquals(t, pa.Cause.String(), "OWNER")
 	assertEquals(t, pa.Command.String(), "/bin/chown nobody:root /etc/passwd")
+	assertEquals(t, pa.Owner, "uid 65534 (nobody), gid 0 (root)")
+
+	// Numeric ids, with or without a passwd entry
+	pf.AddUser("0")
+	pf.AddGroup("0")
+	assertEquals(t, Chown(pf) == nil, true)
+
+	pf.AddUser("31337")
+	pf.AddGroup("31337")
+	pa = Chown(pf)
+	assertEquals(t, pa.Command.String(), "/bin/chown 31337:31337 /etc/passwd")
+	assertEquals(t, pa.Owner, "uid 31337, gid 31337")
+
+	// Described in saved plans too
+	plan := NewPetsPlan("sample_pet", []*PetsFile{pf}, []*PetsFile{pf}, []*PetsAction{pa})
+	assertEquals(t, plan.Actions[0].Owner, "uid 31337, gid 31337")
+	loaded, err := plan.PetsActions([]*PetsFile{pf})
+	assertNoError(t, err)
+	assertEquals(t, loaded[0].Owner, "uid 31337, gid 31337")
 }
 
 func TestLn(t *testing.T) {
@@ -115,7 +138,7 @@ func TestLn(t *testing.T) {
 	pf.Source = "sample_pet/vimrc"
 
 	// Link attribute and Dest not set
-	pa := LinkToCreate(pf)
+	pa := LinkToCreate(pf, pf.NeedsLink())
 	if pa != nil {
 		t.Errorf("Expecting nil, got %v instead", pa)
 	}
@@ -123,7 +146,7 @@ func TestLn(t *testing.T) {
 	// Destination already exists
 	pf.AddLink("/etc/passwd")
 
-	pa = LinkToCreate(pf)
+	pa = LinkToCreate(pf, pf.NeedsLink())
 	if pa != nil {
 		t.Errorf("Expecting nil, got %v instead", pa)
 	}
@@ -131,13 +154,20 @@ func TestLn(t *testing.T) {
 	// Happy path, destination does not exist yet
 	pf.AddLink("/tmp/vimrc")
 
-	pa = LinkToCreate(pf)
+	pa = LinkToCreate(pf, pf.NeedsLink())
 	if pa == nil {
 		t.Errorf("Expecting some action, got nil instead")
 	}
 
 	assertEquals(t, pa.Cause.String(), "LINK_CREATE")
 	assertEquals(t, pa.Command.String(), "/bin/ln -s sample_pet/vimrc /tmp/vimrc")
+
+	// Relative link target
+	pf.Source = "/srv/pets/vimrc"
+	assertNoError(t, pf.AddRelative("true"))
+
+	pa = LinkToCreate(pf, pf.NeedsLink())
+	assertEquals(t, pa.Command.String(), "/bin/ln -s ../srv/pets/vimrc /tmp/vimrc")
 }
 
 func TestMkdir(t *testing.T) {
@@ -165,3 +195,349 @@ func TestMkdir(t *testing.T) {
 	assertEquals(t, pa.Cause.String(), "DIR_CREATE")
 	assertEquals(t, pa.Command.String(), "/bin/mkdir -p /etc/polpette/al/sugo")
 }
+
+func TestNewPetsActionsHandlers(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	sshd, err := NewTestFile("sample_pet/ssh/sshd_config", "", tmpDir+"/sshd_config", "root", "root", "0644", "", "/bin/systemctl reload ssh")
+	assertNoError(t, err)
+	sshd.Pkgs = []PetsPackage{}
+
+	sshdConf, err := NewTestFile("sample_pet/ssh/user_ssh_config", "", tmpDir+"/sshd_config.d/pets.conf", "root", "root", "0644", "", "/bin/systemctl reload ssh")
+	assertNoError(t, err)
+	sshdConf.Pkgs = []PetsPackage{}
+
+	vimrc, err := NewTestFile("sample_pet/vimrc", "", tmpDir+"/vimrc", "root", "root", "0644", "", "/bin/true")
+	assertNoError(t, err)
+	vimrc.Pkgs = []PetsPackage{}
+	vimrc.PostImmediate = true
+
+	actions := NewPetsActions([]*PetsFile{sshd, sshdConf, vimrc})
+
+	posts := []*PetsAction{}
+	for _, action := range actions {
+		if action.Cause == POST {
+			posts = append(posts, action)
+		}
+	}
+
+	// Immediate post-update command first, reload ssh only once at the end
+	assertEquals(t, len(posts), 2)
+	assertEquals(t, posts[0].Command.String(), "/bin/true")
+	assertEquals(t, posts[0].Trigger, vimrc)
+	assertEquals(t, len(posts[0].Notifiers), 0)
+
+	assertEquals(t, actions[len(actions)-1], posts[1])
+	assertEquals(t, posts[1].Command.String(), "/bin/systemctl reload ssh")
+	assertEquals(t, posts[1].Trigger, sshd)
+	assertEquals(t, len(posts[1].Notifiers), 2)
+	assertEquals(t, posts[1].Notifiers[1], sshdConf)
+}
+
+func TestPkgsToRemove(t *testing.T) {
+	isTodo, _ := PkgsToRemove([]*PetsFile{})
+	assertEquals(t, isTodo, false)
+
+	pf := NewPetsFile()
+	pf.AbsentPkgs = []PetsPackage{"abiword"}
+
+	isTodo, _ = PkgsToRemove([]*PetsFile{pf})
+	assertEquals(t, isTodo, false)
+
+	// Any version of binutils has to be removed, once
+	pf.AbsentPkgs = append(pf.AbsentPkgs, "binutils", "binutils=0.1")
+	isTodo, cmd := PkgsToRemove([]*PetsFile{pf})
+	assertEquals(t, isTodo, true)
+	assertEquals(t, cmd.Args[len(cmd.Args)-1], "binutils")
+	assertEquals(t, cmd.Args[len(cmd.Args)-2], "remove")
+}
+
+func TestFileToDelete(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	savedBackupDir := BackupDir
+	t.Cleanup(func() { BackupDir = savedBackupDir })
+	BackupDir = filepath.Join(tmpDir, "backups")
+
+	dest := filepath.Join(tmpDir, "old-job")
+
+	pf := NewPetsFile()
+	pf.Source = "/dev/null"
+	pf.AddAbsent(dest)
+	pf.AddPost("/bin/true")
+
+	// Absent already
+	assertEquals(t, len(FileToDelete(pf)), 0)
+	assertEquals(t, len(NewPetsActions([]*PetsFile{pf})), 0)
+
+	assertNoError(t, os.WriteFile(dest, []byte("* * * * * root true\n"), 0644))
+
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 3)
+	assertEquals(t, actions[0].Cause.String(), "DIR_CREATE")
+	assertEquals(t, actions[1].Cause.String(), "FILE_DELETE")
+	assertEquals(t, actions[2].Cause.String(), "POST_UPDATE")
+
+	assertEquals(t, RunActions(actions), 0)
+
+	_, err := os.Stat(dest)
+	assertEquals(t, os.IsNotExist(err), true)
+
+	backup := actions[1].Command.Args[2]
+	content, err := os.ReadFile(backup)
+	assertNoError(t, err)
+	assertEquals(t, string(content), "* * * * * root true\n")
+
+	// Back again, the first backup is kept
+	assertNoError(t, os.WriteFile(dest, []byte("@daily root true\n"), 0644))
+	pf.AddPost("/bin/true")
+
+	actions = NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, RunActions(actions), 0)
+
+	content, err = os.ReadFile(backup)
+	assertNoError(t, err)
+	assertEquals(t, string(content), "* * * * * root true\n")
+
+	content, err = os.ReadFile(actions[0].Command.Args[2])
+	assertNoError(t, err)
+	assertEquals(t, string(content), "@daily root true\n")
+}
+
+func TestDirPermissions(t *testing.T) {
+	tmpDir := t.TempDir()
+	ssh := filepath.Join(tmpDir, "home", ".ssh")
+
+	pf := NewPetsFile()
+	pf.Source = "/dev/null"
+	pf.AddDest(filepath.Join(ssh, "config"))
+	uid := strconv.Itoa(os.Getuid())
+	pf.AddDirUser(uid)
+	assertNoError(t, pf.AddDirMode("0700"))
+	assertError(t, pf.AddDirMode("rwx"))
+
+	assertEquals(t, len(missingDirs(ssh)), 2)
+
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 6)
+	assertEquals(t, actions[0].Cause.String(), "DIR_CREATE")
+	assertEquals(t, actions[1].Command.String(), "/bin/chown "+uid+" "+filepath.Dir(ssh))
+	assertEquals(t, actions[2].Command.String(), "/bin/chmod 0700 "+filepath.Dir(ssh))
+	assertEquals(t, actions[3].Cause.String(), "OWNER")
+	assertEquals(t, actions[4].Command.String(), "/bin/chmod 0700 "+ssh)
+	assertEquals(t, actions[5].Cause.String(), "FILE_CREATE")
+
+	assertEquals(t, RunActions(actions), 0)
+
+	fileInfo, err := os.Stat(ssh)
+	assertNoError(t, err)
+	assertEquals(t, fileInfo.Mode().Perm(), os.FileMode(0700))
+
+	// Existing directories are left alone, unless asked otherwise
+	assertNoError(t, os.Chmod(ssh, 0755))
+	assertEquals(t, len(DirPermissions(pf)), 0)
+
+	assertNoError(t, pf.AddDirEnforce("true"))
+	actions = DirPermissions(pf)
+	assertEquals(t, len(actions), 1)
+	assertEquals(t, actions[0].Command.String(), "/bin/chmod 0700 "+ssh)
+
+	// A directory owner that does not exist yet leaves the owner of the
+	// file alone
+	pf.AddUser(uid)
+	pf.AddDirUser("never-did-this-user-exist")
+	assertEquals(t, Chown(pf) == nil, true)
+
+	actions = DirPermissions(pf)
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, actions[0].Command.String(), "/bin/chown never-did-this-user-exist "+ssh)
+
+	// Nor does it stop the chown of the file
+	assertNoError(t, os.Chown(filepath.Join(ssh, "config"), 31337, -1))
+	actions = []*PetsAction{Chown(pf), actions[0]}
+	assertEquals(t, chownsDest(actions[0]), true)
+	assertEquals(t, chownsDest(actions[1]), false)
+	assertEquals(t, RunActions(actions), 1)
+
+	fileInfo, err = os.Stat(filepath.Join(ssh, "config"))
+	assertNoError(t, err)
+	assertEquals(t, int(fileInfo.Sys().(*syscall.Stat_t).Uid), os.Getuid())
+}
+
+func TestLinkToReplace(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	savedBackupDir := BackupDir
+	t.Cleanup(func() { BackupDir = savedBackupDir })
+	BackupDir = filepath.Join(tmpDir, "backups")
+
+	source := filepath.Join(tmpDir, "site.conf")
+	assertNoError(t, os.WriteFile(source, []byte("server {}\n"), 0644))
+
+	dest := filepath.Join(tmpDir, "default")
+	assertNoError(t, os.WriteFile(dest, []byte("distro default\n"), 0644))
+
+	pf := NewPetsFile()
+	pf.Source = source
+	pf.AddLink(dest)
+
+	// Existing files are left alone by default
+	assertEquals(t, len(NewPetsActions([]*PetsFile{pf})), 0)
+
+	assertNoError(t, pf.AddForce("true"))
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 3)
+	assertEquals(t, actions[0].Cause.String(), "DIR_CREATE")
+	assertEquals(t, actions[1].Cause.String(), "LINK_REPLACE")
+	assertEquals(t, actions[2].Cause.String(), "LINK_CREATE")
+
+	// The link is planned although the file is still in its way
+	assertEquals(t, len(LinkToReplace(pf, pf.NeedsLink())), 2)
+	assertEquals(t, LinkToCreate(pf, pf.NeedsLink()).Cause.String(), "LINK_CREATE")
+	assertEquals(t, LinkToCreate(pf, NONE) == nil, true)
+
+	assertEquals(t, RunActions(actions), 0)
+
+	target, err := os.Readlink(dest)
+	assertNoError(t, err)
+	assertEquals(t, target, source)
+
+	content, err := os.ReadFile(actions[1].Command.Args[2])
+	assertNoError(t, err)
+	assertEquals(t, string(content), "distro default\n")
+
+	// Wrong symlinks are replaced too
+	assertNoError(t, os.Remove(dest))
+	assertNoError(t, os.Symlink("/nonexistent", dest))
+	actions = NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, actions[0].Cause.String(), "LINK_REPLACE")
+
+	assertEquals(t, RunActions(actions), 0)
+	assertEquals(t, len(NewPetsActions([]*PetsFile{pf})), 0)
+}
+
+func TestSymlinkOwnership(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	source := filepath.Join(tmpDir, "vimrc")
+	assertNoError(t, os.WriteFile(source, []byte("syntax on\n"), 0644))
+
+	dest := filepath.Join(tmpDir, "link")
+	assertNoError(t, os.Symlink(source, dest))
+
+	// The link itself is chowned
+	pf := NewPetsFile()
+	pf.Source = source
+	pf.AddLink(dest)
+	pf.AddUser("31337")
+
+	pa := Chown(pf)
+	assertEquals(t, pa.Command.String(), "/bin/chown -h 31337 "+dest)
+
+	// Symlinks have no mode
+	assertNoError(t, pf.AddMode("0600"))
+	assertEquals(t, Chmod(pf) == nil, true)
+	assertEquals(t, pf.IsValid(true), false)
+
+	// Regular files never write through a symlink at their destination
+	other := NewPetsFile()
+	other.Source = filepath.Join(tmpDir, "other")
+	assertNoError(t, os.WriteFile(other.Source, []byte("syntax off\n"), 0644))
+	other.AddDest(dest)
+	other.AddUser("31337")
+	assertNoError(t, other.AddMode("0600"))
+
+	assertEquals(t, other.NeedsCopy(), PetsCause(NONE))
+	assertEquals(t, Chown(other) == nil, true)
+	assertEquals(t, Chmod(other) == nil, true)
+	assertEquals(t, other.IsValid(true), false)
+	assertEquals(t, other.RefusesSymlink(), true)
+}
+
+func TestFileReplacingSymlink(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	savedBackupDir := BackupDir
+	t.Cleanup(func() { BackupDir = savedBackupDir })
+	BackupDir = filepath.Join(tmpDir, "backups")
+
+	source := filepath.Join(tmpDir, "resolv.conf")
+	assertNoError(t, os.WriteFile(source, []byte("nameserver 127.0.0.1\n"), 0644))
+
+	target := filepath.Join(tmpDir, "stub-resolv.conf")
+	assertNoError(t, os.WriteFile(target, []byte("nameserver 127.0.0.53\n"), 0644))
+
+	dest := filepath.Join(tmpDir, "etc-resolv.conf")
+	assertNoError(t, os.Symlink(target, dest))
+
+	pf := NewPetsFile()
+	pf.Source = source
+	pf.AddDest(dest)
+	assertNoError(t, pf.AddMode("0600"))
+	assertEquals(t, pf.RefusesSymlink(), true)
+	assertNoError(t, pf.AddForce("true"))
+	assertEquals(t, pf.RefusesSymlink(), false)
+	assertEquals(t, pf.IsValid(true), true)
+
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 4)
+	assertEquals(t, actions[0].Cause.String(), "DIR_CREATE")
+	assertEquals(t, actions[1].Cause.String(), "LINK_REPLACE")
+	assertEquals(t, actions[2].Cause.String(), "FILE_CREATE")
+	assertEquals(t, actions[3].Cause.String(), "CHMOD")
+	assertEquals(t, RunActions(actions), 0)
+
+	assertEquals(t, isSymlink(dest), false)
+	content, err := os.ReadFile(dest)
+	assertNoError(t, err)
+	assertEquals(t, string(content), "nameserver 127.0.0.1\n")
+
+	// The target of the link is left alone, the link itself is backed up
+	content, err = os.ReadFile(target)
+	assertNoError(t, err)
+	assertEquals(t, string(content), "nameserver 127.0.0.53\n")
+
+	backup, err := os.Readlink(actions[1].Command.Args[2])
+	assertNoError(t, err)
+	assertEquals(t, backup, target)
+
+	fileInfo, err := os.Stat(target)
+	assertNoError(t, err)
+	assertEquals(t, fileInfo.Mode(), os.FileMode(0644))
+
+	// Nothing left to do
+	assertEquals(t, len(NewPetsActions([]*PetsFile{pf})), 0)
+}
+
+func TestDirectoryLink(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	confDir := filepath.Join(tmpDir, "pets")
+	snippets := filepath.Join(confDir, "snippets")
+	assertNoError(t, os.MkdirAll(snippets, 0755))
+	assertNoError(t, os.WriteFile(filepath.Join(snippets, DirMarker), []byte("# pets: symlink="+tmpDir+"/etc/snippets, relative=true\n"), 0644))
+	assertNoError(t, os.WriteFile(filepath.Join(snippets, "ssl.conf"), []byte("ssl_protocols TLSv1.3;\n"), 0644))
+
+	files, err := ParseFiles(confDir)
+	assertNoError(t, err)
+	assertEquals(t, len(files), 1)
+
+	actions := NewPetsActions(files)
+	assertEquals(t, len(actions), 2)
+	assertEquals(t, actions[0].Cause.String(), "DIR_CREATE")
+	assertEquals(t, actions[1].Cause.String(), "LINK_CREATE")
+	assertEquals(t, RunActions(actions), 0)
+
+	target, err := os.Readlink(filepath.Join(tmpDir, "etc", "snippets"))
+	assertNoError(t, err)
+	assertEquals(t, target, "../pets/snippets")
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "snippets", "ssl.conf"))
+	assertNoError(t, err)
+	assertEquals(t, string(content), "ssl_protocols TLSv1.3;\n")
+
+	// Nothing left to do
+	assertEquals(t, len(NewPetsActions(files)), 0)
+}
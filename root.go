@@ -0,0 +1,191 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// Alternate root support. With -root, pets configures the system mounted
+// under a given directory, such as a chroot or a VM image being built, instead
+// of the live one. Destination paths are resolved under the root, owners and
+// groups are looked up in the user database of the root, and package managers
+// are told to operate on it.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// RootDir is the directory all destination paths are relative to. The empty
+// string stands for the live system.
+var RootDir = ""
+
+// RootPath returns the given absolute path resolved under RootDir.
+func RootPath(path string) string {
+	if RootDir == "" {
+		return path
+	}
+
+	return filepath.Join(RootDir, path)
+}
+
+// readDb returns the entries of the given colon-separated database file (eg:
+// /etc/passwd) under RootDir, split in fields.
+func readDb(dbFile string) ([][]string, error) {
+	f, err := os.Open(RootPath(dbFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := [][]string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Split(scanner.Text(), ":"); len(fields) >= 4 {
+			entries = append(entries, fields)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// findEntry returns the entry with the given value in the given field, or
+// nil.
+func findEntry(entries [][]string, field int, value string) []string {
+	for _, entry := range entries {
+		if entry[field] == value {
+			return entry
+		}
+	}
+	return nil
+}
+
+// dbEntry returns the fields of the line of the given colon-separated
+// database file (eg: /etc/passwd) under RootDir whose first field is name, or
+// whose id field is name if that is a number. nil is returned if there is no
+// such entry.
+func dbEntry(dbFile, name string) ([]string, error) {
+	entries, err := readDb(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsNumericId(name) {
+		// The id is the third field in both passwd(5) and group(5)
+		return findEntry(entries, 2, name), nil
+	}
+
+	return findEntry(entries, 0, name), nil
+}
+
+// IsNumericId returns true if the given owner or group is a uid or gid rather
+// than a name.
+func IsNumericId(name string) bool {
+	return validId(name) == nil
+}
+
+// LookupUser is like user.Lookup, but it looks up the user in the
+// /etc/passwd file under RootDir when an alternate root is used. Numeric uids
+// are accepted too, and they do not need to have a passwd entry: think of
+// container volumes or NFS exports.
+func LookupUser(userName string) (*user.User, error) {
+	var found *user.User
+	var err error
+
+	if RootDir == "" {
+		if IsNumericId(userName) {
+			found, err = user.LookupId(userName)
+		} else {
+			found, err = user.Lookup(userName)
+		}
+	} else {
+		found, err = lookupRootUser(userName)
+	}
+
+	if err != nil && IsNumericId(userName) {
+		return &user.User{Uid: userName}, nil
+	}
+
+	return found, err
+}
+
+// lookupRootUser looks up the given user under RootDir.
+func lookupRootUser(userName string) (*user.User, error) {
+	fields, err := dbEntry("/etc/passwd", userName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) < 7 {
+		return nil, user.UnknownUserError(userName)
+	}
+
+	return &user.User{
+		Username: fields[0],
+		Uid:      fields[2],
+		Gid:      fields[3],
+		Name:     fields[4],
+		HomeDir:  fields[5],
+	}, nil
+}
+
+// LookupGroup is the LookupUser counterpart for groups, using /etc/group.
+func LookupGroup(groupName string) (*user.Group, error) {
+	var found *user.Group
+	var err error
+
+	if RootDir == "" {
+		if IsNumericId(groupName) {
+			found, err = user.LookupGroupId(groupName)
+		} else {
+			found, err = user.LookupGroup(groupName)
+		}
+	} else {
+		found, err = lookupRootGroup(groupName)
+	}
+
+	if err != nil && IsNumericId(groupName) {
+		return &user.Group{Gid: groupName}, nil
+	}
+
+	return found, err
+}
+
+// lookupRootGroup looks up the given group under RootDir.
+func lookupRootGroup(groupName string) (*user.Group, error) {
+	fields, err := dbEntry("/etc/group", groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	if fields == nil {
+		return nil, user.UnknownGroupError(groupName)
+	}
+
+	return &user.Group{
+		Name: fields[0],
+		Gid:  fields[2],
+	}, nil
+}
+
+// DescribeId returns the given uid or gid followed by the corresponding name,
+// if known. Eg: "33 (www-data)".
+func DescribeId(id, name string) string {
+	if name == "" {
+		return id
+	}
+	return fmt.Sprintf("%s (%s)", id, name)
+}
+
+// withRoot inserts the given options, telling a package manager to operate on
+// RootDir, right after the command name. The command is returned unchanged if
+// no alternate root is used.
+func withRoot(args []string, rootOpts ...string) []string {
+	if RootDir == "" {
+		return args
+	}
+
+	return append(append([]string{args[0]}, rootOpts...), args[1:]...)
+}
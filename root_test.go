@@ -0,0 +1,137 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRoot returns a directory with a minimal user database.
+func newTestRoot(t *testing.T) string {
+	root := t.TempDir()
+	assertNoError(t, os.Mkdir(filepath.Join(root, "etc"), 0755))
+
+	passwd := "root:x:0:0:root:/root:/bin/bash\nsparrow:x:4242:4243:Jack Sparrow:/home/sparrow:/bin/sh\n"
+	assertNoError(t, os.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(passwd), 0644))
+
+	group := "root:x:0:\npirates:x:4243:sparrow\n"
+	assertNoError(t, os.WriteFile(filepath.Join(root, "etc", "group"), []byte(group), 0644))
+
+	return root
+}
+
+func TestRootPath(t *testing.T) {
+	assertEquals(t, RootPath("/etc/motd"), "/etc/motd")
+
+	withRootDir(t, "/mnt/target")
+	assertEquals(t, RootPath("/etc/motd"), "/mnt/target/etc/motd")
+}
+
+func TestLookupUserGroup(t *testing.T) {
+	withRootDir(t, newTestRoot(t))
+
+	user, err := LookupUser("sparrow")
+	assertNoError(t, err)
+	assertEquals(t, user.Uid, "4242")
+	assertEquals(t, user.Gid, "4243")
+	assertEquals(t, user.HomeDir, "/home/sparrow")
+
+	group, err := LookupGroup("pirates")
+	assertNoError(t, err)
+	assertEquals(t, group.Gid, "4243")
+
+	// Users of the live system are not there
+	_, err = LookupUser("nobody")
+	assertError(t, err)
+
+	_, err = LookupGroup("nogroup")
+	assertError(t, err)
+}
+
+func TestWithRoot(t *testing.T) {
+	args := []string{"apk", "add"}
+	assertEquals(t, len(withRoot(args, "--root", RootDir)), 2)
+
+	withRootDir(t, "/mnt/target")
+	args = withRoot(args, "--root", RootDir)
+	assertEquals(t, len(args), 4)
+	assertEquals(t, args[1], "--root")
+	assertEquals(t, args[2], "/mnt/target")
+	assertEquals(t, args[3], "add")
+
+	assertEquals(t, strings.Join((&Apt{}).Install([]PetsPackage{"vim"}).Args, " "), "apt-get -o Dir=/mnt/target -o DPkg::Options::=--root=/mnt/target -y install vim")
+	assertEquals(t, (&Dnf{Command: "dnf"}).Remove([]PetsPackage{"vim"}).Args[1], "--installroot=/mnt/target")
+	assertEquals(t, (&Pacman{Command: "pacman"}).Install([]PetsPackage{"vim"}).Args[1], "--root")
+}
+
+func TestRootFile(t *testing.T) {
+	root := newTestRoot(t)
+	withRootDir(t, root)
+
+	pf, err := NewTestFile("/dev/null", "", "/etc/motd", "sparrow", "pirates", "0644", "", "")
+	assertNoError(t, err)
+	assertEquals(t, pf.Dest, filepath.Join(root, "etc", "motd"))
+	assertEquals(t, pf.Directory, filepath.Join(root, "etc"))
+
+	// Numeric ids, as chown(1) would look names up on the live system
+	chown := Chown(pf)
+	assertEquals(t, chown.Command.Args[1], "4242:4243")
+
+	// Dependencies can refer to the destination path without the root
+	other := NewPetsFile()
+	other.Source = "/etc/pets/other"
+	assertEquals(t, findPetsFile([]*PetsFile{pf}, other, "/etc/motd"), pf)
+}
+
+func TestRootCommands(t *testing.T) {
+	root := newTestRoot(t)
+	withRootDir(t, root)
+
+	out := filepath.Join(t.TempDir(), "out")
+
+	// None of them would run inside the root
+	pf := NewPetsFile()
+	pf.Source = "/dev/null"
+	pf.AddDest("/etc/motd")
+	pf.AddPre("/bin/false")
+	pf.AddPost("/bin/sh -c echo>>" + out)
+	pf.AddOnFail("/bin/sh -c echo>>" + out)
+	assertEquals(t, runPre(pf, false), true)
+
+	actions := NewPetsActions([]*PetsFile{pf})
+	assertEquals(t, len(actions), 1)
+	assertEquals(t, actions[0].Cause.String(), "FILE_CREATE")
+	assertEquals(t, RunActions(actions), 0)
+
+	pf.RunOnFail("VALIDATION", os.ErrInvalid)
+
+	_, err := os.Stat(out)
+	assertEquals(t, os.IsNotExist(err), true)
+}
+
+func TestLookupNumericIds(t *testing.T) {
+	withRootDir(t, newTestRoot(t))
+
+	user, err := LookupUser("4242")
+	assertNoError(t, err)
+	assertEquals(t, user.Username, "sparrow")
+	assertEquals(t, DescribeId(user.Uid, user.Username), "4242 (sparrow)")
+
+	// No passwd entry needed
+	user, err = LookupUser("31337")
+	assertNoError(t, err)
+	assertEquals(t, user.Uid, "31337")
+	assertEquals(t, DescribeId(user.Uid, user.Username), "31337")
+
+	group, err := LookupGroup("4243")
+	assertNoError(t, err)
+	assertEquals(t, group.Name, "pirates")
+
+	group, err = LookupGroup("31337")
+	assertNoError(t, err)
+	assertEquals(t, group.Gid, "31337")
+	assertEquals(t, group.Name, "")
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// System services. Pets files can ask for services to be enabled, disabled,
+// running, stopped or masked. The current state is queried from the service
+// manager at planning time, so that drift shows up in dry-run mode too.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// ServiceStates are the states a service can be asked to be in, in the order
+// they are applied.
+var ServiceStates = []string{"enabled", "disabled", "masked", "running", "stopped"}
+
+// conflictingStates lists the states that cannot be asked for together.
+var conflictingStates = [][2]string{
+	{"enabled", "disabled"},
+	{"running", "stopped"},
+	{"masked", "enabled"},
+	{"masked", "running"},
+}
+
+// A PetsService is a service that has to be in the given States.
+type PetsService struct {
+	Name   string
+	States []string
+}
+
+// A ServiceManager knows how to query and change the state of services.
+type ServiceManager interface {
+	// Name returns the name of the service manager, eg: systemd
+	Name() string
+
+	// Detect returns true if this is the service manager of the system
+	Detect() bool
+
+	// State returns the current states of the given service among
+	// ServiceStates. Services which do not exist have no state.
+	State(name string) []string
+
+	// Command returns the command to bring the given service in the given
+	// state, or nil if that is not supported. The pseudo-state "unmasked"
+	// is used before enabling or starting masked services.
+	Command(name, state string) *exec.Cmd
+}
+
+// ServiceManagers supported by pets, in detection order.
+var ServiceManagers = []ServiceManager{
+	&Systemd{},
+	&OpenRC{},
+}
+
+// The service manager is detected only once per run.
+var detectedServiceManager ServiceManager
+
+// svcCmdRunner runs service manager queries. Tests replace it to feed backends
+// with canned command output.
+var svcCmdRunner = RunCmd
+
+// svcQuery runs the given service manager query and returns its trimmed
+// stdout. Queries exit with non-zero status to tell that a service is, say,
+// inactive: that is not an error.
+func svcQuery(args ...string) string {
+	stdout, _, err := svcCmdRunner(NewCmd(args))
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			log.Printf("[ERROR] running %v: %v\n", args, err)
+		}
+	}
+	return strings.TrimSpace(stdout)
+}
+
+// UseServiceManager skips detection and makes pets use the given service
+// manager. nil means that there is none.
+func UseServiceManager(sm ServiceManager) {
+	detectedServiceManager = sm
+}
+
+// WhichServiceManager is available on the system, nil if none of the supported
+// ones is.
+func WhichServiceManager() ServiceManager {
+	if detectedServiceManager != nil {
+		return detectedServiceManager
+	}
+
+	for _, sm := range ServiceManagers {
+		if sm.Detect() {
+			detectedServiceManager = sm
+			return sm
+		}
+	}
+
+	return nil
+}
+
+// AddService parses a 'service' directive: the service name, followed by the
+// states it has to be in. Services are enabled and running by default.
+func (pf *PetsFile) AddService(argument string) error {
+	fields := strings.Fields(argument)
+	if len(fields) == 0 {
+		return fmt.Errorf("missing service name")
+	}
+
+	service := PetsService{Name: fields[0], States: fields[1:]}
+	if len(service.States) == 0 {
+		service.States = []string{"enabled", "running"}
+	}
+
+	for _, state := range service.States {
+		if !SliceContains(ServiceStates, state) {
+			return fmt.Errorf("invalid state '%s' for service %s", state, service.Name)
+		}
+	}
+
+	if err := checkStates(service.Name, service.States); err != nil {
+		return err
+	}
+
+	pf.Services = append(pf.Services, service)
+	return nil
+}
+
+// checkStates returns an error if the given states of a service conflict.
+func checkStates(name string, states []string) error {
+	for _, conflict := range conflictingStates {
+		if SliceContains(states, conflict[0]) && SliceContains(states, conflict[1]) {
+			return fmt.Errorf("service %s cannot be both %s and %s", name, conflict[0], conflict[1])
+		}
+	}
+	return nil
+}
+
+// CheckServices returns an error if different files ask for conflicting
+// states of the same service.
+func CheckServices(files []*PetsFile) error {
+	states := make(map[string][]string)
+	sources := make(map[string][]string)
+
+	for _, pf := range files {
+		for _, service := range pf.Services {
+			states[service.Name] = append(states[service.Name], service.States...)
+			sources[service.Name] = append(sources[service.Name], pf.Source)
+
+			if err := checkStates(service.Name, states[service.Name]); err != nil {
+				return fmt.Errorf("[ERROR] conflicting states in %v: %v\n", sources[service.Name], err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// servicesSupported returns true if the service manager can bring the
+// services of the given file in the requested states.
+func servicesSupported(pf *PetsFile) bool {
+	if len(pf.Services) == 0 {
+		return true
+	}
+
+	sm := WhichServiceManager()
+	if sm == nil {
+		log.Printf("[ERROR] %s has service directives, but there is no service manager\n", pf.Source)
+		return false
+	}
+
+	for _, service := range pf.Services {
+		for _, state := range service.States {
+			if sm.Command(service.Name, state) == nil {
+				log.Printf("[ERROR] %s: %s does not support %s services\n", pf.Source, sm.Name(), state)
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// ServiceActions returns the SERVICE PetsActions needed to bring the services
+// of the given trigger in the requested states.
+func ServiceActions(trigger *PetsFile) []*PetsAction {
+	actions := []*PetsAction{}
+
+	sm := WhichServiceManager()
+	if sm == nil {
+		return actions
+	}
+
+	newAction := func(name, state string) {
+		actions = append(actions, &PetsAction{
+			Cause:   SERVICE,
+			Command: sm.Command(name, state),
+			Trigger: trigger,
+		})
+	}
+
+	for _, service := range trigger.Services {
+		current := sm.State(service.Name)
+
+		if SliceContains(current, "masked") && !SliceContains(service.States, "masked") {
+			log.Printf("[INFO] service %s is masked\n", service.Name)
+			newAction(service.Name, "unmasked")
+		}
+
+		for _, state := range ServiceStates {
+			if !SliceContains(service.States, state) {
+				continue
+			}
+
+			if SliceContains(current, state) {
+				log.Printf("[DEBUG] service %s is %s already\n", service.Name, state)
+				continue
+			}
+
+			if RootDir != "" && (state == "running" || state == "stopped") {
+				log.Printf("[INFO] services cannot be started or stopped in %s, ignoring %s state of %s\n", RootDir, state, service.Name)
+				continue
+			}
+
+			log.Printf("[INFO] service %s is not %s\n", service.Name, state)
+			newAction(service.Name, state)
+		}
+	}
+
+	return actions
+}
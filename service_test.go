@@ -0,0 +1,118 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAddService(t *testing.T) {
+	pf := NewPetsFile()
+
+	assertNoError(t, pf.AddService("nginx"))
+	assertEquals(t, pf.Services[0].Name, "nginx")
+	assertEquals(t, len(pf.Services[0].States), 2)
+
+	assertNoError(t, pf.AddService("exim4 disabled stopped"))
+	assertEquals(t, pf.Services[1].States[1], "stopped")
+
+	assertError(t, pf.AddService("nginx sleepy"))
+	assertError(t, pf.AddService("nginx running stopped"))
+	assertError(t, pf.AddService("nginx masked running"))
+	assertError(t, pf.AddService(""))
+	assertEquals(t, len(pf.Services), 2)
+}
+
+func TestCheckServices(t *testing.T) {
+	first := NewPetsFile()
+	first.Source = "/etc/pets/nginx"
+	assertNoError(t, first.AddService("nginx enabled"))
+
+	second := NewPetsFile()
+	second.Source = "/etc/pets/site"
+	assertNoError(t, second.AddService("nginx running"))
+
+	assertNoError(t, CheckGlobalConstraints([]*PetsFile{first, second}))
+
+	assertNoError(t, second.AddService("nginx disabled"))
+	assertError(t, CheckGlobalConstraints([]*PetsFile{first, second}))
+}
+
+func TestSystemdActions(t *testing.T) {
+	withServiceManager(t, &Systemd{})
+	withSvcOutput(t, map[string]string{
+		"systemctl is-enabled nginx": "masked\n",
+		"systemctl is-active nginx":  "inactive\n",
+		"systemctl is-enabled ssh":   "enabled\n",
+		"systemctl is-active ssh":    "active\n",
+	})
+
+	assertEquals(t, len((&Systemd{}).State("nginx")), 2)
+	assertEquals(t, len((&Systemd{}).State("polpette")), 0)
+
+	pf := NewPetsFile()
+	pf.Source = "/etc/pets/nginx"
+	assertNoError(t, pf.AddService("nginx"))
+	assertNoError(t, pf.AddService("ssh"))
+
+	actions := ServiceActions(pf)
+	assertEquals(t, len(actions), 3)
+	assertEquals(t, actions[0].Cause.String(), "SERVICE")
+	assertEquals(t, actions[0].Command.String(), NewCmd([]string{"systemctl", "unmask", "nginx"}).String())
+	assertEquals(t, actions[1].Command.String(), NewCmd([]string{"systemctl", "enable", "nginx"}).String())
+	assertEquals(t, actions[2].Command.String(), NewCmd([]string{"systemctl", "start", "nginx"}).String())
+
+	// Services come after files, and are handled once
+	tmpDir := t.TempDir()
+	other := NewPetsFile()
+	other.Source = filepath.Join(tmpDir, "site")
+	assertNoError(t, os.WriteFile(other.Source, []byte("server {}\n"), 0644))
+	assertNoError(t, other.AddService("nginx running"))
+	other.AddPost("/bin/systemctl reload nginx")
+	other.Dest = filepath.Join(tmpDir, "site.conf")
+	actions = NewPetsActions([]*PetsFile{other, pf})
+	assertEquals(t, len(actions), 5)
+	assertEquals(t, actions[0].Cause.String(), "FILE_CREATE")
+	assertEquals(t, actions[1].Command.String(), NewCmd([]string{"systemctl", "unmask", "nginx"}).String())
+	assertEquals(t, actions[2].Command.String(), NewCmd([]string{"systemctl", "start", "nginx"}).String())
+	assertEquals(t, actions[3].Command.String(), NewCmd([]string{"systemctl", "enable", "nginx"}).String())
+	assertEquals(t, actions[4].Cause.String(), "POST_UPDATE")
+
+	// Either file is enough for the shared service actions to run
+	assertEquals(t, len(actions[1].Notifiers), 2)
+	assertEquals(t, len(actions[2].Notifiers), 2)
+	assertEquals(t, len(actions[3].Notifiers), 1)
+	assertEquals(t, actions[1].Notifiers[1], pf)
+}
+
+func TestOpenRCRoot(t *testing.T) {
+	root := t.TempDir()
+	withRootDir(t, root)
+	withServiceManager(t, &OpenRC{})
+
+	openrc := &OpenRC{}
+	assertEquals(t, openrc.Detect(), false)
+
+	runlevel := filepath.Join(root, "etc", "runlevels", "default")
+	assertNoError(t, os.MkdirAll(runlevel, 0755))
+	assertNoError(t, os.Symlink("/etc/init.d/sshd", filepath.Join(runlevel, "sshd")))
+
+	assertEquals(t, strings.Join(openrc.State("sshd"), " "), "enabled")
+	assertEquals(t, strings.Join(openrc.State("nginx"), " "), "disabled")
+
+	pf := NewPetsFile()
+	pf.Source = "/etc/pets/nginx"
+	assertNoError(t, pf.AddService("nginx"))
+
+	// Services cannot be started in the root
+	actions := ServiceActions(pf)
+	assertEquals(t, len(actions), 1)
+	assertEquals(t, actions[0].Command.String(), "/bin/ln -s /etc/init.d/nginx "+filepath.Join(runlevel, "nginx"))
+
+	// No masking with OpenRC
+	assertNoError(t, pf.AddService("exim masked"))
+	assertEquals(t, pf.IsValid(true), false)
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// OpenRC backend, for Alpine, Gentoo and friends.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// OpenRC is the ServiceManager of Alpine and Gentoo. Services are enabled in
+// the default runlevel.
+type OpenRC struct{}
+
+func (openrc *OpenRC) Name() string {
+	return "openrc"
+}
+
+func (openrc *OpenRC) Detect() bool {
+	_, err := os.Stat(RootPath("/sbin/openrc"))
+	return err == nil
+}
+
+// runlevelLink returns the path of the symbolic link enabling the given
+// service in the default runlevel.
+func runlevelLink(name string) string {
+	return RootPath(filepath.Join("/etc/runlevels/default", name))
+}
+
+// State looks for the service in the default runlevel, and parses the output
+// of rc-service status, eg: " * status: started". The running state is not
+// known in an alternate root.
+func (openrc *OpenRC) State(name string) []string {
+	states := []string{"disabled"}
+	if _, err := os.Lstat(runlevelLink(name)); err == nil {
+		states = []string{"enabled"}
+	}
+
+	if RootDir != "" {
+		return states
+	}
+
+	status := svcQuery("rc-service", name, "status")
+	if strings.HasSuffix(status, "started") {
+		states = append(states, "running")
+	} else if strings.HasSuffix(status, "stopped") {
+		states = append(states, "stopped")
+	}
+
+	return states
+}
+
+// Command returns nil for masked services, OpenRC has no such thing. In an
+// alternate root services are enabled by creating the runlevel link, which is
+// what rc-update does.
+func (openrc *OpenRC) Command(name, state string) *exec.Cmd {
+	switch state {
+	case "enabled":
+		if RootDir != "" {
+			return NewCmd([]string{"/bin/ln", "-s", filepath.Join("/etc/init.d", name), runlevelLink(name)})
+		}
+		return NewCmd([]string{"rc-update", "add", name, "default"})
+	case "disabled":
+		if RootDir != "" {
+			return NewCmd([]string{"/bin/rm", "-f", runlevelLink(name)})
+		}
+		return NewCmd([]string{"rc-update", "del", name, "default"})
+	case "running":
+		return NewCmd([]string{"rc-service", name, "start"})
+	case "stopped":
+		return NewCmd([]string{"rc-service", name, "stop"})
+	}
+
+	return nil
+}
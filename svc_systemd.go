@@ -0,0 +1,85 @@
+// Copyright (C) 2022 Emanuele Rocca
+//
+// systemd backend.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Systemd is the ServiceManager of most Linux distributions.
+type Systemd struct{}
+
+func (systemd *Systemd) Name() string {
+	return "systemd"
+}
+
+// Detect checks if the system was booted with systemd, see sd_booted(3). In an
+// alternate root, which is not booted, look for systemd itself.
+func (systemd *Systemd) Detect() bool {
+	paths := []string{"/run/systemd/system"}
+	if RootDir != "" {
+		paths = []string{"/usr/lib/systemd/systemd", "/lib/systemd/systemd"}
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(RootPath(path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// systemctl returns a systemctl command line operating on RootDir.
+func systemctl(args ...string) []string {
+	return withRoot(append([]string{"systemctl"}, args...), "--root", RootDir)
+}
+
+// State parses the output of systemctl is-enabled and is-active. Units
+// started by other means than being enabled, such as static ones, count as
+// enabled. The active state is not known in an alternate root.
+func (systemd *Systemd) State(name string) []string {
+	states := []string{}
+
+	switch svcQuery(systemctl("is-enabled", name)...) {
+	case "enabled", "enabled-runtime", "static", "indirect", "generated", "alias":
+		states = append(states, "enabled")
+	case "masked", "masked-runtime":
+		states = append(states, "masked")
+	case "disabled":
+		states = append(states, "disabled")
+	}
+
+	if RootDir != "" {
+		return states
+	}
+
+	switch svcQuery("systemctl", "is-active", name) {
+	case "active", "activating", "reloading":
+		states = append(states, "running")
+	case "inactive", "failed":
+		states = append(states, "stopped")
+	}
+
+	return states
+}
+
+func (systemd *Systemd) Command(name, state string) *exec.Cmd {
+	verbs := map[string]string{
+		"enabled":  "enable",
+		"disabled": "disable",
+		"masked":   "mask",
+		"unmasked": "unmask",
+		"running":  "start",
+		"stopped":  "stop",
+	}
+
+	verb, ok := verbs[state]
+	if !ok {
+		return nil
+	}
+
+	return NewCmd(systemctl(verb, name))
+}
@@ -11,7 +11,9 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"testing"
 )
@@ -43,6 +45,21 @@ func RunCmd(cmd *exec.Cmd) (string, string, error) {
 	return outb.String(), errb.String(), err
 }
 
+// ExitStatus returns the exit status of a process given the error returned by
+// cmd.Run(): 0 on success, the process exit code if it ran and failed, and -1
+// if it could not be started at all.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return exitError.ExitCode()
+	}
+
+	return -1
+}
+
 // Sha256 returns the sha256 of the given file. Shocking, I know.
 func Sha256(fileName string) (string, error) {
 	f, err := os.Open(fileName)
@@ -92,6 +109,75 @@ func assertError(t *testing.T, err error) {
 	}
 }
 
+// withPkgOutput makes package manager commands return the given stdout,
+// keyed by command line, instead of actually running them. Commands not in
+// the map fail as if they were not installed.
+func withPkgOutput(t *testing.T, outputs map[string]string) {
+	savedRunner := pkgCmdRunner
+	t.Cleanup(func() { pkgCmdRunner = savedRunner })
+
+	pkgCmdRunner = func(cmd *exec.Cmd) (string, string, error) {
+		stdout, ok := outputs[strings.Join(cmd.Args, " ")]
+		if !ok {
+			return "", "", &exec.Error{Name: cmd.Args[0], Err: exec.ErrNotFound}
+		}
+		return stdout, "", nil
+	}
+}
+
+// withSvcOutput is the withPkgOutput counterpart for service manager queries.
+func withSvcOutput(t *testing.T, outputs map[string]string) {
+	savedRunner := svcCmdRunner
+	t.Cleanup(func() { svcCmdRunner = savedRunner })
+
+	svcCmdRunner = func(cmd *exec.Cmd) (string, string, error) {
+		stdout, ok := outputs[strings.Join(cmd.Args, " ")]
+		if !ok {
+			return "", "", &exec.Error{Name: cmd.Args[0], Err: exec.ErrNotFound}
+		}
+		return stdout, "", nil
+	}
+}
+
+// withServiceManager makes pets use the given service manager for the
+// duration of the test.
+func withServiceManager(t *testing.T, sm ServiceManager) {
+	savedSm := detectedServiceManager
+	t.Cleanup(func() { UseServiceManager(savedSm) })
+
+	UseServiceManager(sm)
+}
+
+// withFakePackages makes pets use the fake package manager for the duration of
+// the test, and returns the path to its state file.
+func withFakePackages(t *testing.T, state *FakePackageState) string {
+	stateFile := filepath.Join(t.TempDir(), "packages.json")
+	if err := state.Save(stateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	withPackageManager(t, &Fake{StateFile: stateFile})
+	return stateFile
+}
+
+// withPackageManager makes pets use the given package manager for the
+// duration of the test.
+func withPackageManager(t *testing.T, pm PackageManager) {
+	savedPm := detectedPackageManager
+	t.Cleanup(func() { UsePackageManager(savedPm) })
+
+	UsePackageManager(pm)
+}
+
+// withRootDir makes pets use the given alternate root for the duration of the
+// test.
+func withRootDir(t *testing.T, root string) {
+	savedRoot := RootDir
+	t.Cleanup(func() { RootDir = savedRoot })
+
+	RootDir = root
+}
+
 func NewTestFile(src, pkg, dest, userName, groupName, mode, pre, post string) (*PetsFile, error) {
 	var err error
 
@@ -101,13 +187,15 @@ func NewTestFile(src, pkg, dest, userName, groupName, mode, pre, post string) (*
 
 	p.AddDest(dest)
 
-	err = p.AddUser(userName)
-	if err != nil {
-		return nil, err
+	if userName != "" {
+		p.AddUser(userName)
 	}
 
-	err = p.AddGroup(groupName)
-	if err != nil {
+	if groupName != "" {
+		p.AddGroup(groupName)
+	}
+
+	if err = p.ResolveOwner(); err != nil {
 		return nil, err
 	}
 
@@ -11,6 +11,9 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 // CheckGlobalConstraints validates assumptions that must hold across all
@@ -23,6 +26,11 @@ func CheckGlobalConstraints(files []*PetsFile) error {
 	seen := make(map[string]*PetsFile)
 
 	for _, pf := range files {
+		if pf.Dest == "" {
+			// Only removing packages, managing accounts or services
+			continue
+		}
+
 		other, exist := seen[pf.Dest]
 		if exist {
 			return fmt.Errorf("[ERROR] duplicate definition for '%s': '%s' and '%s'\n", pf.Dest, pf.Source, other.Source)
@@ -30,6 +38,192 @@ func CheckGlobalConstraints(files []*PetsFile) error {
 		seen[pf.Dest] = pf
 	}
 
+	// Different files must not ask for different versions of the same
+	// package
+	pinned := make(map[string]*PetsFile)
+
+	for _, pf := range files {
+		for _, pkg := range pf.Pkgs {
+			if pkg.WantedVersion() == "" {
+				continue
+			}
+
+			other, exist := pinned[pkg.Name()]
+			if exist && !pkgInFile(other, pkg) {
+				return fmt.Errorf("[ERROR] conflicting versions of package '%s' in '%s' and '%s'\n", pkg.Name(), pf.Source, other.Source)
+			}
+			pinned[pkg.Name()] = pf
+		}
+	}
+
+	// Packages cannot be both required and unwanted
+	for _, pf := range files {
+		for _, absent := range pf.AbsentPkgs {
+			for _, other := range files {
+				for _, pkg := range other.Pkgs {
+					if pkg.Name() == absent.Name() {
+						return fmt.Errorf("[ERROR] package '%s' required by '%s' and removed by '%s'\n", pkg.Name(), other.Source, pf.Source)
+					}
+				}
+			}
+		}
+	}
+
+	// Accounts must be defined once, with unique ids
+	if err := CheckAccounts(files); err != nil {
+		return err
+	}
+
+	// Services cannot be asked to be, say, both running and stopped
+	if err := CheckServices(files); err != nil {
+		return err
+	}
+
+	if err := ResolveDependencies(files); err != nil {
+		return err
+	}
+
+	// Early files are applied before all the others, hence they cannot
+	// depend on them
+	for _, pf := range files {
+		if !pf.IsEarly() {
+			continue
+		}
+
+		for _, other := range pf.AfterFiles {
+			if !other.IsEarly() {
+				return fmt.Errorf("[ERROR] early file '%s' cannot be applied after '%s'\n", pf.Source, other.Source)
+			}
+		}
+	}
+
+	// Make sure the dependencies can be satisfied in some order
+	_, err := SortPetsFiles(files)
+	return err
+}
+
+// CheckConfDir returns an error if any file is to be installed in the
+// configuration directory, which pets must never modify. That includes copying
+// files over symbolic links pointing there.
+func CheckConfDir(files []*PetsFile, confDir string) error {
+	confDir, err := filepath.Abs(confDir)
+	if err != nil {
+		return err
+	}
+
+	// Compare real paths, in case of symbolic links along the way
+	realConfDir, err := filepath.EvalSymlinks(confDir)
+	if err != nil {
+		realConfDir = confDir
+	}
+
+	for _, pf := range files {
+		if pf.Dest == "" {
+			continue
+		}
+
+		dests := []string{pf.Dest}
+		if realDir, err := filepath.EvalSymlinks(filepath.Dir(pf.Dest)); err == nil {
+			dests = append(dests, filepath.Join(realDir, filepath.Base(pf.Dest)))
+		}
+
+		for _, dest := range dests {
+			if inDir(dest, confDir, realConfDir) {
+				return fmt.Errorf("[ERROR] '%s' cannot be installed to '%s', in the configuration directory\n", pf.Source, pf.Dest)
+			}
+		}
+
+		// Symbolic links to files in the configuration directory are
+		// expected, unless something is to be copied over them
+		if !symlinkAtDest(pf) {
+			continue
+		}
+
+		target, err := filepath.EvalSymlinks(pf.Dest)
+		if err != nil {
+			// Dangling link, copying would create its target
+			target, err = os.Readlink(pf.Dest)
+			if err == nil && !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(pf.Dest), target)
+			}
+		}
+
+		if err == nil && inDir(target, confDir, realConfDir) {
+			return fmt.Errorf("[ERROR] '%s' cannot be installed to '%s', a symbolic link to '%s' in the configuration directory\n", pf.Source, pf.Dest, target)
+		}
+	}
+
+	return nil
+}
+
+// inDir returns true if path is any of the given directories, or is within
+// one of them.
+func inDir(path string, dirs ...string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pkgInFile returns true if pf has the given package among its packages.
+func pkgInFile(pf *PetsFile, pkg PetsPackage) bool {
+	for _, other := range pf.Pkgs {
+		if other == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// findPetsFile returns the file referenced by ref in an 'after' or 'requires'
+// directive of pf, or nil if there is no such file. References can either be
+// the source or the destination of the file. Relative source paths are
+// relative to the directory of pf.
+func findPetsFile(files []*PetsFile, pf *PetsFile, ref string) *PetsFile {
+	if !filepath.IsAbs(ref) {
+		ref = filepath.Join(filepath.Dir(pf.Source), ref)
+	}
+
+	for _, other := range files {
+		if other.Source == ref || other.Dest == RootPath(ref) {
+			return other
+		}
+	}
+
+	return nil
+}
+
+// ResolveDependencies fills AfterFiles and RequiredFiles for all the given
+// files, and returns an error if any reference cannot be resolved.
+func ResolveDependencies(files []*PetsFile) error {
+	for _, pf := range files {
+		pf.AfterFiles = []*PetsFile{}
+		pf.RequiredFiles = []*PetsFile{}
+
+		// Requires first, so that we know which ones are required by index
+		refs := append(append([]string{}, pf.Requires...), pf.After...)
+
+		for i, ref := range refs {
+			other := findPetsFile(files, pf, ref)
+
+			if other == nil {
+				return fmt.Errorf("[ERROR] '%s' depends on '%s', which is not a pets file\n", pf.Source, ref)
+			}
+
+			if other == pf {
+				return fmt.Errorf("[ERROR] '%s' depends on itself\n", pf.Source)
+			}
+
+			pf.AfterFiles = append(pf.AfterFiles, other)
+
+			if i < len(pf.Requires) {
+				pf.RequiredFiles = append(pf.RequiredFiles, other)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -41,28 +235,36 @@ func runPre(pf *PetsFile, pathErrorOK bool) bool {
 		return true
 	}
 
+	// The command would run on the live system instead of the alternate
+	// root
+	if RootDir != "" {
+		log.Printf("[INFO] not running pre-update command '%s' of %s in %s\n", pf.Pre, pf.Source, RootDir)
+		return true
+	}
+
 	// Some optimism.
 	toReturn := true
 
 	// Run 'pre' validation command, append Source filename to
-	// arguments.
+	// arguments. Use a new command, as files can be validated more than
+	// once.
 	// eg: /usr/sbin/sshd -t -f sample_pet/ssh/sshd_config
-	pf.Pre.Args = append(pf.Pre.Args, pf.Source)
+	pre := NewCmd(append(append([]string{}, pf.Pre.Args...), pf.Source))
 
-	stdout, stderr, err := RunCmd(pf.Pre)
+	stdout, stderr, err := RunCmd(pre)
 
 	_, pathError := err.(*fs.PathError)
 
 	if err == nil {
-		log.Printf("[INFO] pre-update command %s successful\n", pf.Pre.Args)
+		log.Printf("[INFO] pre-update command %s successful\n", pre.Args)
 	} else if pathError && pathErrorOK {
 		// The command has failed because the validation command itself is
 		// missing. This could be a chicken-and-egg problem: at this stage
 		// configuration is not validated yet, hence any "package" directives
 		// have not been applied.  Do not consider this as a failure, for now.
-		log.Printf("[INFO] pre-update command %s failed due to PathError. Ignoring for now\n", pf.Pre.Args)
+		log.Printf("[INFO] pre-update command %s failed due to PathError. Ignoring for now\n", pre.Args)
 	} else {
-		log.Printf("[ERROR] pre-update command %s: %s\n", pf.Pre.Args, err)
+		log.Printf("[ERROR] pre-update command %s: %s\n", pre.Args, err)
 		toReturn = false
 	}
 
@@ -82,6 +284,12 @@ func runPre(pf *PetsFile, pathErrorOK bool) bool {
 // it but proceed with the rest. The function returns a slice of files for
 // which validation passed.
 func CheckLocalConstraints(files []*PetsFile, pathErrorOK bool) []*PetsFile {
+	return dropMissingRequirements(validFiles(files, pathErrorOK))
+}
+
+// validFiles returns the given files which are valid on their own, regardless
+// of their requirements.
+func validFiles(files []*PetsFile, pathErrorOK bool) []*PetsFile {
 	var goodPets []*PetsFile
 
 	for _, pf := range files {
@@ -97,3 +305,60 @@ func CheckLocalConstraints(files []*PetsFile, pathErrorOK bool) []*PetsFile {
 
 	return goodPets
 }
+
+// dropMissingRequirements returns the given valid files, except those
+// requiring a file which is not among them.
+func dropMissingRequirements(goodPets []*PetsFile) []*PetsFile {
+	// Files requiring an invalid file are invalid too. Removing a file may
+	// invalidate others, hence keep going until nothing changes.
+	for removed := true; removed; {
+		removed = false
+
+		for i, pf := range goodPets {
+			if missing := missingRequirement(pf, goodPets); missing != nil {
+				log.Printf("[ERROR] skipping %s: required file %s is invalid\n", pf.Source, missing.Source)
+				goodPets = append(goodPets[:i], goodPets[i+1:]...)
+				removed = true
+				break
+			}
+		}
+	}
+
+	return goodPets
+}
+
+// missingRequirement returns the first file required by pf which is not in
+// the given slice, or nil if all of them are there.
+func missingRequirement(pf *PetsFile, files []*PetsFile) *PetsFile {
+	for _, required := range pf.RequiredFiles {
+		if !containsPetsFile(files, required) {
+			return required
+		}
+	}
+
+	return nil
+}
+
+// containsPetsFile returns true if the given slice contains pf.
+func containsPetsFile(files []*PetsFile, pf *PetsFile) bool {
+	for _, other := range files {
+		if other == pf {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidFiles returns the files which are not in goodPets, as returned by
+// CheckLocalConstraints.
+func InvalidFiles(files, goodPets []*PetsFile) []*PetsFile {
+	badPets := []*PetsFile{}
+
+	for _, pf := range files {
+		if !containsPetsFile(goodPets, pf) {
+			badPets = append(badPets, pf)
+		}
+	}
+
+	return badPets
+}
@@ -0,0 +1,220 @@
+// Copyright (C) 2022 Emanuele Rocca
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newDepsTestFiles() (*PetsFile, *PetsFile, *PetsFile) {
+	repo := NewPetsFile()
+	repo.Source = "/etc/pets/apt/nginx.list"
+	repo.AddDest("/etc/apt/sources.list.d/nginx.list")
+
+	nginx := NewPetsFile()
+	nginx.Source = "/etc/pets/nginx/nginx.conf"
+	nginx.AddDest("/etc/nginx/nginx.conf")
+
+	site := NewPetsFile()
+	site.Source = "/etc/pets/nginx/site.conf"
+	site.AddDest("/etc/nginx/sites-enabled/site.conf")
+
+	return repo, nginx, site
+}
+
+func TestResolveDependencies(t *testing.T) {
+	repo, nginx, site := newDepsTestFiles()
+
+	// By destination
+	nginx.AddRequires("/etc/apt/sources.list.d/nginx.list")
+	// By source, relative to the directory of site.conf
+	site.AddAfter("nginx.conf")
+
+	files := []*PetsFile{site, nginx, repo}
+	assertNoError(t, CheckGlobalConstraints(files))
+
+	assertEquals(t, len(nginx.AfterFiles), 1)
+	assertEquals(t, nginx.AfterFiles[0], repo)
+	assertEquals(t, len(nginx.RequiredFiles), 1)
+	assertEquals(t, nginx.RequiredFiles[0], repo)
+
+	assertEquals(t, len(site.AfterFiles), 1)
+	assertEquals(t, site.AfterFiles[0], nginx)
+	assertEquals(t, len(site.RequiredFiles), 0)
+
+	sorted, err := SortPetsFiles(files)
+	assertNoError(t, err)
+	assertEquals(t, sorted[0], repo)
+	assertEquals(t, sorted[1], nginx)
+	assertEquals(t, sorted[2], site)
+}
+
+func TestResolveDependenciesErrors(t *testing.T) {
+	repo, nginx, site := newDepsTestFiles()
+	files := []*PetsFile{repo, nginx, site}
+
+	nginx.AddAfter("/etc/not/a/pets/file")
+	assertError(t, CheckGlobalConstraints(files))
+
+	nginx.After = []string{"/etc/nginx/nginx.conf"}
+	assertError(t, CheckGlobalConstraints(files))
+
+	nginx.After = []string{"site.conf"}
+	site.AddRequires("/etc/apt/sources.list.d/nginx.list")
+	assertNoError(t, CheckGlobalConstraints(files))
+
+	// Cycle
+	repo.AddAfter("/etc/nginx/nginx.conf")
+	assertError(t, CheckGlobalConstraints(files))
+}
+
+func TestCheckLocalConstraintsRequires(t *testing.T) {
+	bad, err := NewTestFile("/dev/null", "", "/tmp/bad", "root", "root", "0644", "/bin/false", "")
+	assertNoError(t, err)
+	bad.Pkgs = []PetsPackage{}
+
+	good, err := NewTestFile("/dev/null", "", "/tmp/good", "root", "root", "0644", "", "")
+	assertNoError(t, err)
+	good.Pkgs = []PetsPackage{}
+	good.AddRequires("/tmp/bad")
+
+	files := []*PetsFile{good, bad}
+	assertNoError(t, CheckGlobalConstraints(files))
+
+	goodPets := CheckLocalConstraints(files, false)
+	assertEquals(t, len(goodPets), 0)
+}
+
+func TestCheckGlobalConstraintsVersions(t *testing.T) {
+	repo, nginx, site := newDepsTestFiles()
+	files := []*PetsFile{repo, nginx, site}
+
+	nginx.Pkgs = []PetsPackage{"nginx=1.24.*"}
+	site.Pkgs = []PetsPackage{"nginx"}
+	assertNoError(t, CheckGlobalConstraints(files))
+
+	site.Pkgs = []PetsPackage{"nginx=1.24.*"}
+	assertNoError(t, CheckGlobalConstraints(files))
+
+	site.Pkgs = []PetsPackage{"nginx=1.22.*"}
+	assertError(t, CheckGlobalConstraints(files))
+}
+
+func TestCheckGlobalConstraintsAbsentPackages(t *testing.T) {
+	repo, nginx, site := newDepsTestFiles()
+	files := []*PetsFile{repo, nginx, site}
+
+	nginx.Pkgs = []PetsPackage{"nginx"}
+	site.AbsentPkgs = []PetsPackage{"apache2"}
+	assertNoError(t, CheckGlobalConstraints(files))
+
+	repo.AbsentPkgs = []PetsPackage{"nginx=1.22.*"}
+	assertError(t, CheckGlobalConstraints(files))
+
+	// Files without destination are not duplicates
+	telnet := NewPetsFile()
+	telnet.Source = "/etc/pets/telnet"
+	telnet.AbsentPkgs = []PetsPackage{"telnet"}
+	rpcbind := NewPetsFile()
+	rpcbind.Source = "/etc/pets/rpcbind"
+	rpcbind.AbsentPkgs = []PetsPackage{"rpcbind"}
+	assertNoError(t, CheckGlobalConstraints([]*PetsFile{telnet, rpcbind}))
+}
+
+func TestCheckGlobalConstraintsEarly(t *testing.T) {
+	withPackageManager(t, &Apt{})
+
+	repo, nginx, site := newDepsTestFiles()
+	files := []*PetsFile{repo, nginx, site}
+
+	assertEquals(t, repo.IsEarly(), true)
+	assertEquals(t, nginx.IsEarly(), false)
+
+	nginx.AddRequires("/etc/apt/sources.list.d/nginx.list")
+	assertNoError(t, CheckGlobalConstraints(files))
+
+	// Early files cannot wait for the others
+	repo.AddAfter("/etc/nginx/sites-enabled/site.conf")
+	assertError(t, CheckGlobalConstraints(files))
+
+	// Unless they are early too
+	assertNoError(t, site.AddPhase("early"))
+	assertNoError(t, CheckGlobalConstraints(files))
+}
+
+func TestCheckGlobalConstraintsAccounts(t *testing.T) {
+	newAccountFile := func(src, user, uid, group, gid string) *PetsFile {
+		pf := NewPetsFile()
+		pf.Source = src
+		if user != "" {
+			pf.AddAccount(user)
+			assertNoError(t, pf.AddUid(uid))
+		}
+		if group != "" {
+			pf.AddAccountGroup(group)
+			assertNoError(t, pf.AddGid(gid))
+		}
+		return pf
+	}
+
+	sparrow := newAccountFile("/etc/pets/sparrow", "sparrow", "4242", "pirates", "4243")
+	barbossa := newAccountFile("/etc/pets/barbossa", "barbossa", "4244", "", "")
+	assertNoError(t, CheckGlobalConstraints([]*PetsFile{sparrow, barbossa}))
+
+	// Same user twice
+	other := newAccountFile("/etc/pets/other", "sparrow", "4245", "", "")
+	assertError(t, CheckGlobalConstraints([]*PetsFile{sparrow, other}))
+
+	// Same uid for different users
+	other = newAccountFile("/etc/pets/other", "turner", "4242", "", "")
+	assertError(t, CheckGlobalConstraints([]*PetsFile{sparrow, other}))
+
+	// Same gid for different groups
+	other = newAccountFile("/etc/pets/other", "", "", "navy", "4243")
+	assertError(t, CheckGlobalConstraints([]*PetsFile{sparrow, other}))
+
+	// Same group twice
+	other = newAccountFile("/etc/pets/other", "", "", "pirates", "4250")
+	assertError(t, CheckGlobalConstraints([]*PetsFile{sparrow, other}))
+}
+
+func TestCheckConfDir(t *testing.T) {
+	confDir := t.TempDir()
+
+	pf := NewPetsFile()
+	pf.Source = filepath.Join(confDir, "vimrc")
+	pf.AddDest("/etc/vim/vimrc.local")
+	assertNoError(t, CheckConfDir([]*PetsFile{pf}, confDir))
+
+	pf.AddDest(filepath.Join(confDir, "vimrc"))
+	assertError(t, CheckConfDir([]*PetsFile{pf}, confDir))
+
+	// Through a symlink
+	link := filepath.Join(t.TempDir(), "pets")
+	assertNoError(t, os.Symlink(confDir, link))
+	pf.AddDest(filepath.Join(link, "vimrc"))
+	assertError(t, CheckConfDir([]*PetsFile{pf}, confDir))
+
+	// Copying over a symbolic link into the configuration directory
+	dest := filepath.Join(t.TempDir(), "vimrc.local")
+	assertNoError(t, os.Symlink(pf.Source, dest))
+	pf.AddDest(dest)
+	assertError(t, CheckConfDir([]*PetsFile{pf}, confDir))
+
+	// Even if it is dangling
+	assertNoError(t, os.Remove(dest))
+	assertNoError(t, os.Symlink(filepath.Join(confDir, "missing"), dest))
+	assertError(t, CheckConfDir([]*PetsFile{pf}, confDir))
+
+	// Which is what symbolic links managed by pets look like
+	pf.AddLink(dest)
+	assertNoError(t, CheckConfDir([]*PetsFile{pf}, confDir))
+
+	// Symbolic links elsewhere are fine, IsValid takes care of them
+	pf.Link = false
+	assertNoError(t, os.Remove(dest))
+	assertNoError(t, os.Symlink("/etc/hostname", dest))
+	assertNoError(t, CheckConfDir([]*PetsFile{pf}, confDir))
+}